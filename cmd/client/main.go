@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/diceone/for-IT/internal/api"
+	"github.com/diceone/for-IT/internal/executor"
 	"github.com/diceone/for-IT/internal/logging"
 )
 
@@ -18,6 +22,13 @@ func main() {
 	customer := flag.String("customer", "", "Customer name (required)")
 	environment := flag.String("environment", "", "Environment name (required)")
 	debug := flag.Bool("debug", true, "Enable debug logging")
+	factsDir := flag.String("facts-dir", "/etc/for/facts.d", "Directory with custom fact files and scripts")
+	factsTimeout := flag.Duration("facts-timeout", 10*time.Second, "Maximum run time of a custom fact script")
+	modulesDir := flag.String("modules-dir", "/etc/for/modules", "Directory with external modules")
+	stateDir := flag.String("state-dir", "/var/lib/for-client", "Directory for the client's working files, such as modules fetched from the server")
+	outputLimit := flag.Int("output-limit", executor.DefaultOutputLimit, "Bytes of stdout and of stderr of a command kept in its result (0 for no limit)")
+	spoolDir := flag.String("spool-dir", "", "Directory to keep the full output of commands whose output was truncated")
+	taskTimeout := flag.Duration("task-timeout", time.Hour, "Maximum run time of a task without a timeout of its own (0 for no limit)")
 	flag.Parse()
 
 	// Setup logging
@@ -33,6 +44,11 @@ func main() {
 		log.Fatal("Customer and environment parameters are required")
 	}
 
+	// A fact script that hangs would otherwise hold up every run
+	if *factsTimeout <= 0 {
+		log.Fatal("The facts timeout must be greater than zero")
+	}
+
 	log.Printf("Connecting to server at %s (customer: %s, environment: %s)", *serverAddr, *customer, *environment)
 
 	client, err := api.NewClient(*serverAddr, *checkInterval, *customer, *environment)
@@ -40,6 +56,17 @@ func main() {
 		log.Fatalf("Failed to create client: %v", err)
 	}
 
+	client.SetFactsDir(*factsDir, *factsTimeout)
+	client.SetModulesDir(*modulesDir)
+	client.SetStateDir(*stateDir)
+	client.SetTaskTimeout(*taskTimeout)
+	client.SetOutputLimit(*outputLimit)
+	client.SetSpoolDir(*spoolDir)
+
+	// Stop the running task, including its child processes, on shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Set dry run mode if requested
 	if *dryRun {
 		client.SetDryRun(true)
@@ -48,7 +75,7 @@ func main() {
 	// If run-once flag is set, execute once and exit
 	if *runOnce {
 		log.Printf("Running in one-shot mode")
-		err := client.CheckAndExecute()
+		err := client.CheckAndExecute(ctx)
 		if err != nil {
 			log.Printf("Error during execution: %v", err)
 			os.Exit(1)
@@ -59,5 +86,8 @@ func main() {
 
 	// Otherwise run in continuous mode
 	log.Printf("Starting client, connecting to server at %s (check interval: %s)", *serverAddr, *checkInterval)
-	log.Fatal(client.Start())
+	if err := client.Start(ctx); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Client stopped")
 }
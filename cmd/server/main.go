@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 
 	"github.com/diceone/for-IT/internal/api"
@@ -14,8 +15,10 @@ import (
 
 func main() {
 	var (
-		addr        = flag.String("addr", ":8080", "Server address")
-		playbookDir = flag.String("playbook-dir", "playbooks", "Directory containing playbook files")
+		addr            = flag.String("addr", ":8080", "Server address")
+		playbookDir     = flag.String("playbook-dir", "playbooks", "Directory containing playbook files")
+		environmentsDir = flag.String("environments-dir", "environments", "Directory containing environment files and roles")
+		dataDir         = flag.String("data-dir", "/var/lib/for", "Directory for the client inventory, facts and spooled output")
 	)
 	flag.Parse()
 
@@ -30,10 +33,41 @@ func main() {
 		log.Fatalf("Failed to get absolute path for playbook directory: %v", err)
 	}
 
+	absEnvironmentsDir, err := filepath.Abs(*environmentsDir)
+	if err != nil {
+		log.Fatalf("Failed to get absolute path for environments directory: %v", err)
+	}
+
+	// Every YAML file below the playbook directory is loaded as a flat
+	// playbook, so environment files and roles must not be in there
+	if within(absEnvironmentsDir, absPlaybookDir) || within(absPlaybookDir, absEnvironmentsDir) {
+		log.Fatalf("The playbook directory %s and the environments directory %s must not contain each other", absPlaybookDir, absEnvironmentsDir)
+	}
+
 	log.Printf("Using playbook directory: %s", absPlaybookDir)
+	log.Printf("Using environments directory: %s", absEnvironmentsDir)
+
+	// Load environment files and their roles
+	environments, err := api.NewEnvironmentManager(absEnvironmentsDir)
+	if err != nil {
+		log.Fatalf("Failed to load environments: %v", err)
+	}
+	defer environments.Close()
+
+	// Load the inventory of known clients and their facts
+	inventory, err := api.NewInventoryManager(*dataDir)
+	if err != nil {
+		log.Fatalf("Failed to load inventory: %v", err)
+	}
+
+	// Keep the full output of commands that clients upload on request
+	spool, err := api.NewSpoolManager(*dataDir)
+	if err != nil {
+		log.Fatalf("Failed to create spool: %v", err)
+	}
 
 	// Create and start server
-	server, err := api.NewServer(absPlaybookDir)
+	server, err := api.NewServer(absPlaybookDir, environments, inventory, spool)
 	if err != nil {
 		log.Fatalf("Failed to create server: %v", err)
 	}
@@ -59,3 +93,9 @@ func main() {
 		log.Printf("Server error: %v", err)
 	}
 }
+
+// within reports whether path is dir or inside of it.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
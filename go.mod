@@ -3,8 +3,10 @@ module github.com/diceone/for-IT
 go 1.20
 
 require (
-	github.com/fsnotify/fsnotify v1.8.0 // indirect
-	github.com/gobwas/glob v0.2.3 // indirect
-	golang.org/x/sys v0.13.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/fsnotify/fsnotify v1.8.0
+	github.com/gobwas/glob v0.2.3
+	github.com/ulikunitz/xz v0.5.15
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.13.0 // indirect
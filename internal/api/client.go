@@ -2,17 +2,25 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/diceone/for-IT/internal/condition"
 	"github.com/diceone/for-IT/internal/executor"
+	"github.com/diceone/for-IT/internal/facts"
 	"github.com/diceone/for-IT/internal/models"
+	"github.com/diceone/for-IT/internal/modules"
 	"github.com/diceone/for-IT/internal/output"
-	"github.com/gobwas/glob"
+	"github.com/diceone/for-IT/internal/vars"
 )
 
 type Client struct {
@@ -24,6 +32,16 @@ type Client struct {
 	environment    string
 	checkInterval  time.Duration
 	dryRun         bool
+	facts          map[string]interface{}
+	factsDir       string
+	factsTimeout   time.Duration
+	modulesDir     string
+	stateDir       string
+	taskTimeout    time.Duration
+	spoolDir       string
+	// moduleFacts holds the names of the facts external modules set during
+	// a run
+	moduleFacts    map[string]bool
 }
 
 func NewClient(serverAddr string, checkInterval time.Duration, customer string, environment string) (*Client, error) {
@@ -47,21 +65,82 @@ func (c *Client) SetDryRun(enabled bool) {
 	c.dryRun = enabled
 }
 
-func (c *Client) Start() error {
+// SetFactsDir sets the directory custom facts are read from and how long a
+// fact script may run.
+func (c *Client) SetFactsDir(dir string, timeout time.Duration) {
+	c.factsDir = dir
+	c.factsTimeout = timeout
+}
+
+// SetModulesDir sets the directory external modules are looked up in.
+func (c *Client) SetModulesDir(dir string) {
+	c.modulesDir = dir
+}
+
+// SetStateDir sets the directory the client keeps its working files in, such
+// as the external modules fetched from the server.
+func (c *Client) SetStateDir(dir string) {
+	c.stateDir = dir
+}
+
+// SetTaskTimeout sets how long a task may run unless it sets a timeout of its
+// own. Zero means no limit.
+func (c *Client) SetTaskTimeout(timeout time.Duration) {
+	c.taskTimeout = timeout
+}
+
+// SetOutputLimit sets how many bytes of stdout and of stderr of a command
+// are kept in its result.
+func (c *Client) SetOutputLimit(limit int) {
+	c.executor.SetOutputLimit(limit)
+}
+
+// SetSpoolDir sets the directory the full output of commands is kept in when
+// their output is truncated. An empty dir turns spooling off.
+func (c *Client) SetSpoolDir(dir string) {
+	c.spoolDir = dir
+	c.executor.SetSpoolDir(dir)
+}
+
+// Start runs the tasks every check interval until ctx is done.
+func (c *Client) Start(ctx context.Context) error {
 	for {
-		if err := c.CheckAndExecute(); err != nil {
+		if err := c.CheckAndExecute(ctx); err != nil {
 			log.Printf("Error checking tasks: %v", err)
 		}
 
 		if c.checkInterval == 0 {
 			break
 		}
-		time.Sleep(c.checkInterval)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(c.checkInterval):
+		}
 	}
 	return nil
 }
 
-func (c *Client) CheckAndExecute() error {
+// CheckAndExecute fetches the tasks of this host and runs them. When ctx is
+// done the running task is stopped and the remaining tasks are not run.
+func (c *Client) CheckAndExecute(ctx context.Context) error {
+	// Gather facts before every run so that conditions and templates on the
+	// server see the current state of the host
+	c.facts = facts.Gather()
+	if c.factsDir != "" {
+		c.facts["local"] = facts.GatherLocal(c.factsDir, c.factsTimeout)
+	}
+	if err := c.sendFacts(c.facts); err != nil {
+		log.Printf("Error sending facts: %v", err)
+	}
+	c.moduleFacts = make(map[string]bool)
+
+	if c.spoolDir != "" {
+		if err := c.uploadSpool(); err != nil {
+			log.Printf("Error uploading spool files: %v", err)
+		}
+	}
+
 	tasks, _, err := c.getTasks(c.hostname)
 	if err != nil {
 		return fmt.Errorf("failed to get tasks: %v", err)
@@ -71,58 +150,439 @@ func (c *Client) CheckAndExecute() error {
 		return nil
 	}
 
-	var results []models.TaskResult
 	startTime := time.Now()
+	// Results registered by the tasks of this run
+	registered := make(vars.Scope)
+	results, _ := c.runTasks(ctx, tasks, registered, false)
+	if ctx.Err() != nil {
+		log.Printf("Client is shutting down, not running the remaining tasks")
+	}
+
+	duration := time.Since(startTime)
+	fmt.Print(output.FormatPlaybookSummary(results, duration, c.dryRun))
+
+	if len(c.moduleFacts) > 0 {
+		if err := c.sendFacts(c.facts); err != nil {
+			log.Printf("Error sending facts: %v", err)
+		}
+	}
 
+	if err := c.sendResult(results); err != nil {
+		return fmt.Errorf("failed to send results: %v", err)
+	}
+
+	return nil
+}
+
+// runTasks runs tasks in order, the tasks of blocks in their place, and
+// returns their results. With stopOnFailure, as within a block, the first
+// failure that is not rescued stops the tasks and is reported.
+func (c *Client) runTasks(ctx context.Context, tasks []models.Task, registered vars.Scope, stopOnFailure bool) ([]models.TaskResult, bool) {
+	var results []models.TaskResult
 	for _, task := range tasks {
-		result := &models.TaskResult{
-			Name: task.Name,
+		if ctx.Err() != nil {
+			return results, true
 		}
-		taskStartTime := time.Now()
 
-		if task.When != "" {
-			pattern := glob.MustCompile(task.When)
-			if !pattern.Match(c.hostname) {
-				result.SkipReason = fmt.Sprintf("Condition '%s' not met", task.When)
-				results = append(results, *result)
-				fmt.Print(output.FormatTaskOutput(task.Name, *result, c.dryRun))
-				continue
+		if task.Block != nil {
+			blockResults, failed := c.runBlock(ctx, task, registered)
+			results = append(results, blockResults...)
+			if failed && stopOnFailure {
+				return results, true
 			}
+			continue
 		}
 
-		if err := c.executeTask(task, result); err != nil {
+		var result models.TaskResult
+		if task.Loop != nil {
+			result = c.runLoop(ctx, task, registered)
+		} else {
+			result = c.runTask(ctx, task, registered)
+		}
+		results = append(results, result)
+		if task.Register != "" {
+			registered[task.Register] = registerResult(result)
+		}
+		fmt.Print(output.FormatTaskOutput(task.Name, result, c.dryRun))
+		if result.Failed && stopOnFailure {
+			return results, true
+		}
+	}
+	return results, false
+}
+
+// runBlock runs the tasks of a block until one fails, then its rescue tasks,
+// and its always tasks in any case. If the rescue tasks succeed, the failures
+// of the block are marked rescued and the block does not fail.
+func (c *Client) runBlock(ctx context.Context, block models.Task, registered vars.Scope) ([]models.TaskResult, bool) {
+	if block.When != "" {
+		met, err := evalCondition(block.When, c.taskEnv(ctx, block, registered))
+		if err != nil || !met {
+			now := time.Now()
+			result := models.TaskResult{Name: block.Name, StartedAt: now, EndedAt: now}
+			if err != nil {
+				result.Failed = true
+				result.Error = fmt.Sprintf("Condition '%s': %v", block.When, err)
+			} else {
+				result.SkipReason = fmt.Sprintf("Condition '%s' not met", block.When)
+			}
+			fmt.Print(output.FormatTaskOutput(block.Name, result, c.dryRun))
+			return []models.TaskResult{result}, result.Failed
+		}
+	}
+
+	results, failed := c.runTasks(ctx, block.Block, registered, true)
+	if failed && block.Rescue != nil && ctx.Err() == nil {
+		rescueResults, rescueFailed := c.runTasks(ctx, block.Rescue, registered, true)
+		if !rescueFailed {
+			for i := range results {
+				if results[i].Failed {
+					results[i].Rescued = true
+				}
+			}
+			failed = false
+		}
+		results = append(results, rescueResults...)
+	}
+	alwaysResults, alwaysFailed := c.runTasks(ctx, block.Always, registered, true)
+	return append(results, alwaysResults...), failed || alwaysFailed
+}
+
+// runLoop runs a task once per item of its loop, with the item and its index
+// in the variables, and collects the results of the items in one result.
+func (c *Client) runLoop(ctx context.Context, task models.Task, runVars vars.Scope) models.TaskResult {
+	result := models.TaskResult{
+		Name:      task.Name,
+		StartedAt: time.Now(),
+		Results:   []models.TaskResult{},
+	}
+	items, _ := task.Loop.([]interface{})
+
+	var changed, failed, skipped int
+	for index, item := range items {
+		if ctx.Err() != nil {
+			break
+		}
+		itemVars := make(vars.Scope, len(runVars)+2)
+		for name, value := range runVars {
+			itemVars[name] = value
+		}
+		itemVars["item"] = item
+		itemVars["index"] = index
+
+		// Templates get the item through the variables of the task
+		itemTask := task
+		itemTask.Vars = make(map[string]interface{}, len(task.Vars)+2)
+		for name, value := range task.Vars {
+			itemTask.Vars[name] = value
+		}
+		itemTask.Vars["item"] = item
+		itemTask.Vars["index"] = index
+
+		itemResult := c.runTask(ctx, itemTask, itemVars)
+		itemResult.Item = item
+		result.Results = append(result.Results, itemResult)
+		switch {
+		case itemResult.SkipReason != "":
+			skipped++
+		case itemResult.Failed:
+			failed++
+			result.TimedOut = result.TimedOut || itemResult.TimedOut
+		case itemResult.Changed:
+			changed++
+		}
+	}
+	result.EndedAt = time.Now()
+	result.Duration = result.EndedAt.Sub(result.StartedAt)
+
+	result.Changed = changed > 0
+	switch {
+	case len(items) == 0:
+		result.SkipReason = "loop has no items"
+	case failed > 0:
+		result.Failed = true
+		result.Error = fmt.Sprintf("%d of %d items failed", failed, len(items))
+	case skipped == len(items):
+		result.SkipReason = "all items skipped"
+	case changed > 0:
+		result.Output = fmt.Sprintf("%d of %d items changed", changed, len(items))
+	}
+	return result
+}
+
+// runTask checks the condition of a task and runs it within its timeout.
+// runVars holds the variables only the client knows: the results registered
+// by the earlier tasks of the run and the item of a loop.
+func (c *Client) runTask(ctx context.Context, task models.Task, runVars vars.Scope) (result models.TaskResult) {
+	result = models.TaskResult{
+		Name:      task.Name,
+		StartedAt: time.Now(),
+	}
+	defer func() {
+		result.EndedAt = time.Now()
+		result.Duration = result.EndedAt.Sub(result.StartedAt)
+	}()
+
+	timeout := c.taskTimeout
+	if task.Timeout != "" {
+		timeout, _ = time.ParseDuration(task.Timeout)
+	}
+	var taskCtx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		taskCtx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		taskCtx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	env := c.taskEnv(taskCtx, task, runVars)
+	if task.When != "" {
+		met, err := evalCondition(task.When, env)
+		if err != nil {
 			result.Failed = true
-			result.Error = err.Error()
+			result.Error = fmt.Sprintf("Condition '%s': %v", task.When, err)
+			if taskCtx.Err() == context.DeadlineExceeded {
+				result.TimedOut = true
+				result.Error = fmt.Sprintf("Condition '%s' timed out after %s", task.When, timeout)
+			}
+			return result
+		}
+		if !met {
+			result.SkipReason = fmt.Sprintf("Condition '%s' not met", task.When)
+			return result
 		}
+	}
 
-		result.Duration = time.Since(taskStartTime)
-		results = append(results, *result)
+	if task.Deferred {
+		rendered, err := vars.RenderTask(task, runVars)
+		if err != nil {
+			result.Failed = true
+			result.Error = fmt.Sprintf("failed to render the task: %v", err)
+			return result
+		}
+		task = rendered
+	}
 
-		fmt.Print(output.FormatTaskOutput(task.Name, *result, c.dryRun))
+	// Guards run in dry runs as well, so that a dry run only reports the
+	// commands a real run would execute
+	skip, err := c.checkGuards(taskCtx, task)
+	if err == nil && skip != "" {
+		result.SkipReason = skip
+		return result
+	}
+	if err == nil {
+		err = c.executeTask(taskCtx, task, &result)
+		if (task.ChangedWhen != "" || task.FailedWhen != "") && !c.dryRun && taskCtx.Err() == nil {
+			err = c.checkResult(task, env, &result, err)
+		}
 	}
+	switch {
+	case ctx.Err() != nil:
+		result.Failed = true
+		result.Error = "task was stopped because the client is shutting down"
+	case taskCtx.Err() == context.DeadlineExceeded:
+		result.Failed = true
+		result.TimedOut = true
+		result.Error = fmt.Sprintf("task timed out after %s", timeout)
+	case err != nil:
+		result.Failed = true
+		result.Error = err.Error()
+	}
+	return result
+}
 
-	duration := time.Since(startTime)
-	fmt.Print(output.FormatPlaybookSummary(results, duration, c.dryRun))
+// checkGuards returns why the guards of a command task skip it, or "" if it
+// should run. Check commands get the task's variables like the command.
+func (c *Client) checkGuards(ctx context.Context, task models.Task) (string, error) {
+	if task.Creates != "" {
+		if matches, _ := filepath.Glob(task.Creates); len(matches) > 0 {
+			return fmt.Sprintf("creates: %s exists", task.Creates), nil
+		}
+	}
+	if task.Removes != "" {
+		if matches, _ := filepath.Glob(task.Removes); len(matches) == 0 {
+			return fmt.Sprintf("removes: %s does not exist", task.Removes), nil
+		}
+	}
 
-	if err := c.sendResult(results); err != nil {
-		return fmt.Errorf("failed to send results: %v", err)
+	if task.OnlyIf != "" {
+		code, err := c.executor.ExitCodeWithEnv(ctx, task.OnlyIf, task.Variables)
+		if err != nil {
+			return "", fmt.Errorf("onlyif '%s': %v", task.OnlyIf, err)
+		}
+		if code != 0 {
+			return fmt.Sprintf("onlyif: '%s' exited with code %d", task.OnlyIf, code), nil
+		}
+	}
+	if task.Unless != "" {
+		code, err := c.executor.ExitCodeWithEnv(ctx, task.Unless, task.Variables)
+		if err != nil {
+			return "", fmt.Errorf("unless '%s': %v", task.Unless, err)
+		}
+		if code == 0 {
+			return fmt.Sprintf("unless: '%s' succeeded", task.Unless), nil
+		}
+	}
+	return "", nil
+}
+
+// checkResult applies the changed_when and failed_when conditions of a task
+// to its result. err is the error the task ended with; the returned error
+// replaces it. Only a non-zero exit code can be overruled by failed_when,
+// other errors always fail the task.
+func (c *Client) checkResult(task models.Task, env *taskEnv, result *models.TaskResult, err error) error {
+	exited := result.ExitCode != nil && *result.ExitCode > 0
+	if err != nil && !exited {
+		return err
+	}
+
+	env.scope["output"] = result.Output
+	if result.ExitCode != nil {
+		env.scope["rc"] = *result.ExitCode
+		env.scope["stdout"] = result.Stdout
+		env.scope["stderr"] = result.Stderr
 	}
 
+	if task.FailedWhen != "" {
+		failed, evalErr := evalCondition(task.FailedWhen, env)
+		if evalErr != nil {
+			return fmt.Errorf("failed_when '%s': %v", task.FailedWhen, evalErr)
+		}
+		if failed {
+			if err == nil {
+				err = fmt.Errorf("failed_when '%s' is true", task.FailedWhen)
+			}
+			return err
+		}
+		// The command ran, it just exited with an accepted code, which is
+		// not a change by itself
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if task.ChangedWhen != "" {
+		changed, evalErr := evalCondition(task.ChangedWhen, env)
+		if evalErr != nil {
+			return fmt.Errorf("changed_when '%s': %v", task.ChangedWhen, evalErr)
+		}
+		result.Changed = changed
+	}
 	return nil
 }
 
-func (c *Client) executeTask(task models.Task, result *models.TaskResult) error {
+// evalCondition evaluates a condition of a task.
+func evalCondition(src string, env condition.Env) (bool, error) {
+	expr, err := condition.Parse(src)
+	if err != nil {
+		return false, err
+	}
+	return expr.Eval(env)
+}
+
+// taskEnv returns the environment conditions of a task are evaluated in.
+// runVars shadow the variables sent with the task.
+func (c *Client) taskEnv(ctx context.Context, task models.Task, runVars vars.Scope) *taskEnv {
+	scope := make(vars.Scope, len(task.Vars)+len(runVars)+2)
+	for name, value := range task.Vars {
+		scope[name] = value
+	}
+	for name, value := range runVars {
+		scope[name] = value
+	}
+	scope["hostname"] = c.hostname
+	scope["facts"] = c.facts
+
+	return &taskEnv{ctx: ctx, scope: scope, executor: c.executor}
+}
+
+// registerResult returns what a task registers of its result for the tasks
+// after it. rc is only set for commands and results only for loops.
+func registerResult(result models.TaskResult) map[string]interface{} {
+	registered := map[string]interface{}{
+		"changed": result.Changed,
+		"failed":  result.Failed,
+		"skipped": result.SkipReason != "",
+		"output":  result.Output,
+		"stdout":  result.Stdout,
+		"stderr":  result.Stderr,
+	}
+	if result.ExitCode != nil {
+		registered["rc"] = *result.ExitCode
+	}
+	if result.Results != nil {
+		results := make([]interface{}, 0, len(result.Results))
+		for _, itemResult := range result.Results {
+			item := registerResult(itemResult)
+			item["item"] = itemResult.Item
+			results = append(results, item)
+		}
+		registered["results"] = results
+	}
+	return registered
+}
+
+// taskEnv resolves condition references against the variables sent with a
+// task and runs condition commands on the local host.
+type taskEnv struct {
+	ctx      context.Context
+	scope    vars.Scope
+	executor *executor.Executor
+}
+
+func (e *taskEnv) Lookup(path string) (interface{}, bool) {
+	return e.scope.Lookup(path)
+}
+
+func (e *taskEnv) RunCommand(command string) (int, error) {
+	return e.executor.ExitCode(e.ctx, command)
+}
+
+func (c *Client) executeTask(ctx context.Context, task models.Task, result *models.TaskResult) error {
+	// Typed modules check the current state themselves and support dry runs
+	host := &modules.Host{Context: ctx, Executor: c.executor, Facts: c.facts, DryRun: c.dryRun, FetchFile: c.fetchFile, ModulesDir: c.modulesDir}
+	if c.stateDir != "" {
+		host.StagingDir = filepath.Join(c.stateDir, "modules")
+	}
+	if moduleResult, ok, err := modules.Run(host, task); ok {
+		result.Output = moduleResult.Output
+		result.Changed = moduleResult.Changed
+		result.Diff = moduleResult.Diff
+		for name, value := range moduleResult.Facts {
+			// Modules may update the facts they set but not gathered ones
+			if _, ok := c.facts[name]; ok && !c.moduleFacts[name] {
+				log.Printf("Task %q: module %s may not overwrite the fact %q, ignoring it", task.Name, task.Module, name)
+				continue
+			}
+			c.facts[name] = value
+			c.moduleFacts[name] = true
+		}
+		return err
+	}
+
+	command, env, changes := executor.ApplyPolicy(task.PackageManagerDefaults, task.Command, task.Variables)
+	for _, change := range changes {
+		log.Printf("Task %q: %s policy %s", task.Name, task.PackageManagerDefaults, change)
+	}
+	result.Command = command
+
 	if c.dryRun {
-		result.Output = fmt.Sprintf("Would execute: %s", task.Command)
+		result.Output = fmt.Sprintf("Would execute: %s", command)
 		return nil
 	}
 
-	output, err := c.executor.ExecuteWithEnv(task.Command, task.Variables)
+	out, err := c.executor.ExecuteWithEnv(ctx, command, env)
+	result.Output = out.Stdout
+	result.Stdout = out.Stdout
+	result.Stderr = out.Stderr
+	result.ExitCode = &out.ExitCode
+	result.OutputFile = out.Spool
 	if err != nil {
 		return err
 	}
 
-	result.Output = output
 	result.Changed = true
 	return nil
 }
@@ -142,7 +602,8 @@ func (c *Client) getTasks(hostname string) ([]models.Task, string, error) {
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+		body, _ := io.ReadAll(resp.Body)
+		return nil, "", fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
 	}
 
 	var tasks []models.Task
@@ -153,6 +614,99 @@ func (c *Client) getTasks(hostname string) ([]models.Task, string, error) {
 	return tasks, resp.Header.Get("ETag"), nil
 }
 
+// fetchFile downloads a file of a role from the server.
+func (c *Client) fetchFile(role, dir, path string) ([]byte, error) {
+	query := url.Values{"role": {role}, "dir": {dir}, "path": {path}}
+	resp, err := c.client.Get(fmt.Sprintf("http://%s/files?%s", c.serverAddr, query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s/%s of role %s: %w", dir, path, role, os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// uploadSpool uploads the spool files the server asked for.
+func (c *Client) uploadSpool() error {
+	query := url.Values{"hostname": {c.hostname}}
+	resp, err := c.client.Get(fmt.Sprintf("http://%s/spool/requests?%s", c.serverAddr, query.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var files []string
+	if err := json.NewDecoder(resp.Body).Decode(&files); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := c.uploadSpoolFile(file); err != nil {
+			log.Printf("Error uploading spool file %s: %v", file, err)
+			continue
+		}
+		log.Printf("Uploaded spool file %s", file)
+	}
+	return nil
+}
+
+func (c *Client) uploadSpoolFile(file string) error {
+	if file != filepath.Base(file) || strings.HasPrefix(file, ".") {
+		return fmt.Errorf("invalid file name")
+	}
+	f, err := os.Open(filepath.Join(c.spoolDir, file))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	query := url.Values{"hostname": {c.hostname}, "file": {file}}
+	resp, err := c.client.Post(fmt.Sprintf("http://%s/spool?%s", c.serverAddr, query.Encode()), "text/plain", f)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code: %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (c *Client) sendFacts(facts map[string]interface{}) error {
+	data, err := json.Marshal(facts)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("http://%s/facts?hostname=%s", c.serverAddr, c.hostname)
+	resp, err := c.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
 func (c *Client) sendResult(result interface{}) error {
 	data, err := json.Marshal(result)
 	if err != nil {
@@ -6,15 +6,48 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 
+	"github.com/diceone/for-IT/internal/executor"
 	"github.com/diceone/for-IT/internal/models"
+	"github.com/diceone/for-IT/internal/templates"
 	"github.com/fsnotify/fsnotify"
 	"gopkg.in/yaml.v3"
 )
 
+// globalRolesDir is the directory below the base directory holding roles
+// shared by all customers.
+const globalRolesDir = "roles"
+
+// ResolvedEnvironment is an environment file (e.g. prod.yml) whose playbooks
+// have been expanded into ordered task lists.
+type ResolvedEnvironment struct {
+	Customer    string
+	File        string
+	Environment models.Environment
+	Playbooks   []ResolvedPlaybook // in the order they appear in the file
+}
+
+// ResolvedPlaybook is a playbook of an environment file with its role tasks
+// resolved and its hosts patterns compiled.
+type ResolvedPlaybook struct {
+	models.Playbook
+	Targets *HostPattern
+}
+
+// Matches reports whether name refers to this environment. An environment
+// can be addressed by its file name (prod), its name (customer1-production)
+// or its name without the customer prefix (production).
+func (r *ResolvedEnvironment) Matches(name string) bool {
+	base := strings.TrimSuffix(filepath.Base(r.File), filepath.Ext(r.File))
+	return name == base ||
+		name == r.Environment.Name ||
+		name == strings.TrimPrefix(r.Environment.Name, r.Customer+"-")
+}
+
 type EnvironmentManager struct {
-	environments map[string][]models.Playbook
+	environments map[string][]*ResolvedEnvironment // customer -> environments
 	mutex        sync.RWMutex
 	watcher      *fsnotify.Watcher
 	baseDir      string
@@ -27,9 +60,9 @@ func NewEnvironmentManager(baseDir string) (*EnvironmentManager, error) {
 	}
 
 	manager := &EnvironmentManager{
-		environments: make(map[string][]models.Playbook),
-		watcher:     watcher,
-		baseDir:     baseDir,
+		environments: make(map[string][]*ResolvedEnvironment),
+		watcher:      watcher,
+		baseDir:      baseDir,
 	}
 
 	if err := manager.loadEnvironments(); err != nil {
@@ -46,7 +79,7 @@ func (m *EnvironmentManager) loadEnvironments() error {
 		return fmt.Errorf("failed to create base directory: %v", err)
 	}
 
-	if err := m.watcher.Add(m.baseDir); err != nil {
+	if err := m.watchDir(m.baseDir); err != nil {
 		return fmt.Errorf("failed to watch base directory: %v", err)
 	}
 
@@ -56,9 +89,9 @@ func (m *EnvironmentManager) loadEnvironments() error {
 	}
 
 	for _, entry := range entries {
-		if entry.IsDir() {
-			if err := m.loadEnvironment(entry.Name()); err != nil {
-				log.Printf("Error loading environment %s: %v", entry.Name(), err)
+		if entry.IsDir() && entry.Name() != globalRolesDir {
+			if err := m.loadCustomer(entry.Name()); err != nil {
+				log.Printf("Error loading environments for customer %s: %v", entry.Name(), err)
 			}
 		}
 	}
@@ -66,54 +99,268 @@ func (m *EnvironmentManager) loadEnvironments() error {
 	return nil
 }
 
-func (m *EnvironmentManager) loadEnvironment(envName string) error {
-	envDir := filepath.Join(m.baseDir, envName)
-
-	if err := m.watcher.Add(envDir); err != nil {
-		return fmt.Errorf("failed to watch environment directory: %v", err)
-	}
-
-	var playbooks []models.Playbook
-	err := filepath.WalkDir(envDir, func(path string, d fs.DirEntry, err error) error {
+// watchDir adds dir and all of its subdirectories to the watcher so that
+// changes to role files are picked up as well.
+func (m *EnvironmentManager) watchDir(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-
-		if !d.IsDir() && filepath.Ext(path) == ".yml" {
-			playbook, err := m.loadPlaybook(path)
-			if err != nil {
-				log.Printf("Error loading playbook %s: %v", path, err)
-				return nil
+		if d.IsDir() {
+			if err := m.watcher.Add(path); err != nil {
+				return fmt.Errorf("failed to watch %s: %v", path, err)
 			}
-			playbooks = append(playbooks, playbook)
 		}
-
 		return nil
 	})
+}
+
+// loadCustomer loads every environment file found directly in the customer's
+// directory. Other YAML files (flat playbooks, role task files) are ignored.
+func (m *EnvironmentManager) loadCustomer(customer string) error {
+	customerDir := filepath.Join(m.baseDir, customer)
 
+	entries, err := os.ReadDir(customerDir)
 	if err != nil {
-		return fmt.Errorf("failed to walk environment directory: %v", err)
+		return fmt.Errorf("failed to read customer directory: %v", err)
+	}
+
+	var environments []*ResolvedEnvironment
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".yml" {
+			continue
+		}
+
+		path := filepath.Join(customerDir, entry.Name())
+		env, err := m.loadEnvironment(customer, path)
+		if err != nil {
+			log.Printf("Error loading environment %s: %v", path, err)
+			continue
+		}
+		if env == nil {
+			continue
+		}
+
+		log.Printf("Loaded environment %s: customer=%s, playbooks=%d", path, customer, len(env.Playbooks))
+		environments = append(environments, env)
 	}
 
 	m.mutex.Lock()
-	m.environments[envName] = playbooks
+	m.environments[customer] = environments
 	m.mutex.Unlock()
 
 	return nil
 }
 
-func (m *EnvironmentManager) loadPlaybook(path string) (models.Playbook, error) {
+// loadEnvironment parses an environment file and resolves its playbooks.
+// It returns nil without error if the file is not an environment file.
+func (m *EnvironmentManager) loadEnvironment(customer, path string) (*ResolvedEnvironment, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return models.Playbook{}, fmt.Errorf("failed to read playbook file: %v", err)
+		return nil, fmt.Errorf("failed to read environment file: %v", err)
+	}
+
+	var env models.Environment
+	if err := yaml.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal environment: %v", err)
+	}
+	if len(env.Playbooks) == 0 {
+		return nil, nil
 	}
 
-	var playbook models.Playbook
-	if err := yaml.Unmarshal(data, &playbook); err != nil {
-		return models.Playbook{}, fmt.Errorf("failed to unmarshal playbook: %v", err)
+	if err := executor.ValidatePolicy(env.PackageManagerDefaults); err != nil {
+		return nil, fmt.Errorf("package_manager_defaults: %v", err)
+	}
+
+	order, err := playbookOrder(data)
+	if err != nil {
+		return nil, err
 	}
 
-	return playbook, nil
+	resolved := &ResolvedEnvironment{
+		Customer:    customer,
+		File:        path,
+		Environment: env,
+	}
+
+	for _, key := range order {
+		playbook := env.Playbooks[key]
+
+		targets, err := CompileHostPattern(playbook.Hosts)
+		if err != nil {
+			return nil, fmt.Errorf("playbook %s: hosts: %v", key, err)
+		}
+
+		if err := validateTasks(m.displayPath(path), playbook.Tasks); err != nil {
+			return nil, err
+		}
+
+		var tasks []models.Task
+		for _, role := range playbook.IncludeRoles {
+			roleTasks, err := m.loadRole(customer, role)
+			if err != nil {
+				return nil, fmt.Errorf("playbook %s: %v", key, err)
+			}
+			tasks = append(tasks, roleTasks...)
+		}
+		playbook.Tasks = append(tasks, playbook.Tasks...)
+		playbook.Customer = customer
+		playbook.Environment = env.Name
+
+		resolved.Playbooks = append(resolved.Playbooks, ResolvedPlaybook{
+			Playbook: playbook,
+			Targets:  targets,
+		})
+	}
+
+	return resolved, nil
+}
+
+// playbookOrder returns the keys of the playbooks map in file order, which
+// decoding into a Go map loses.
+func playbookOrder(data []byte) ([]string, error) {
+	var doc struct {
+		Playbooks yaml.Node `yaml:"playbooks"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal environment: %v", err)
+	}
+
+	var keys []string
+	for i := 0; i+1 < len(doc.Playbooks.Content); i += 2 {
+		keys = append(keys, doc.Playbooks.Content[i].Value)
+	}
+	return keys, nil
+}
+
+// loadRole returns the tasks of a role, looking in the customer's roles
+// directory first and falling back to the global roles directory.
+func (m *EnvironmentManager) loadRole(customer, role string) ([]models.Task, error) {
+	if role == "" || strings.ContainsAny(role, `/\`) || role == "." || role == ".." {
+		return nil, fmt.Errorf("invalid role name %q", role)
+	}
+
+	candidates := []string{
+		filepath.Join(m.baseDir, customer, "roles", role, "tasks.yml"),
+		filepath.Join(m.baseDir, globalRolesDir, role, "tasks.yml"),
+	}
+
+	for _, path := range candidates {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read role %s: %v", role, err)
+		}
+
+		var playbook models.Playbook
+		if err := yaml.Unmarshal(data, &playbook); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal role %s: %v", role, err)
+		}
+		roleDir := filepath.ToSlash(m.displayPath(filepath.Dir(path)))
+		setRole(playbook.Tasks, roleDir)
+		if err := validateTasks(m.displayPath(path), playbook.Tasks); err != nil {
+			return nil, err
+		}
+		if err := m.checkTemplates(m.displayPath(path), roleDir, playbook.Tasks); err != nil {
+			return nil, err
+		}
+		return playbook.Tasks, nil
+	}
+
+	return nil, fmt.Errorf("role %s not found in %s", role, strings.Join(candidates, " or "))
+}
+
+// checkTemplates makes sure the templates used by the tasks of a role exist
+// and parse, so that syntax errors show up when the role is loaded.
+func (m *EnvironmentManager) checkTemplates(file, role string, tasks []models.Task) error {
+	for _, task := range tasks {
+		for _, blockTasks := range [][]models.Task{task.Block, task.Rescue, task.Always} {
+			if err := m.checkTemplates(file, role, blockTasks); err != nil {
+				return err
+			}
+		}
+		if task.Template == nil {
+			continue
+		}
+		line := task.KeyLine("template")
+		path, err := m.RoleFile(role, "templates", task.Template.Source)
+		if err != nil {
+			return fmt.Errorf("%s:%d: task %q: template %s: %v", file, line, task.Name, task.Template.Source, err)
+		}
+		text, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%s:%d: task %q: %v", file, line, task.Name, err)
+		}
+		// Parse errors name the template file and line themselves
+		if _, err := templates.Parse(filepath.ToSlash(m.displayPath(path)), string(text)); err != nil {
+			return fmt.Errorf("%s:%d: task %q: %v", file, line, task.Name, err)
+		}
+	}
+	return nil
+}
+
+// setRole sets the role of tasks and of the tasks of their blocks.
+func setRole(tasks []models.Task, role string) {
+	for i := range tasks {
+		tasks[i].Role = role
+		setRole(tasks[i].Block, role)
+		setRole(tasks[i].Rescue, role)
+		setRole(tasks[i].Always, role)
+	}
+}
+
+// roleFileDirs are the directories of a role that clients may fetch files
+// from.
+var roleFileDirs = map[string]bool{"files": true, "templates": true, "library": true}
+
+// RoleFile returns the path of a file in a directory such as files/ of a
+// role. role is the role directory relative to the base directory as set
+// in Task.Role. The file must not lie outside that directory, also not
+// through a symlink.
+func (m *EnvironmentManager) RoleFile(role, dir, name string) (string, error) {
+	parts := strings.Split(role, "/")
+	valid := (len(parts) == 2 && parts[0] == globalRolesDir) ||
+		(len(parts) == 3 && parts[1] == "roles" && parts[0] != globalRolesDir)
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." || strings.Contains(part, `\`) {
+			valid = false
+		}
+	}
+	if !valid {
+		return "", fmt.Errorf("invalid role %q", role)
+	}
+	if !roleFileDirs[dir] {
+		return "", fmt.Errorf("invalid directory %q", dir)
+	}
+	if name == "" {
+		return "", fmt.Errorf("file name is required")
+	}
+
+	root := filepath.Join(m.baseDir, filepath.FromSlash(role), dir)
+	path := filepath.Join(root, filepath.FromSlash(filepath.Clean("/"+name)))
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(realRoot, realPath); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of %s", name, m.displayPath(root))
+	}
+	return path, nil
+}
+
+// displayPath shortens paths below the base directory for error messages.
+func (m *EnvironmentManager) displayPath(path string) string {
+	if rel, err := filepath.Rel(m.baseDir, path); err == nil {
+		return rel
+	}
+	return path
 }
 
 func (m *EnvironmentManager) watchEnvironments() {
@@ -124,27 +371,40 @@ func (m *EnvironmentManager) watchEnvironments() {
 				return
 			}
 
+			relPath, err := filepath.Rel(m.baseDir, event.Name)
+			if err != nil || relPath == "." {
+				continue
+			}
+			customer := strings.Split(relPath, string(filepath.Separator))[0]
+
 			// Handle directory events
 			if filepath.Ext(event.Name) == "" {
 				switch event.Op {
 				case fsnotify.Create:
-					if err := m.loadEnvironment(filepath.Base(event.Name)); err != nil {
-						log.Printf("Error loading new environment: %v", err)
+					if err := m.watchDir(event.Name); err != nil {
+						log.Printf("Error watching new directory: %v", err)
 					}
 				case fsnotify.Remove:
-					m.mutex.Lock()
-					delete(m.environments, filepath.Base(event.Name))
-					m.mutex.Unlock()
+					if relPath == customer {
+						m.mutex.Lock()
+						delete(m.environments, customer)
+						m.mutex.Unlock()
+						continue
+					}
+				default:
+					continue
 				}
+			} else if filepath.Ext(event.Name) != ".yml" {
 				continue
 			}
 
-			// Handle playbook file events
-			if filepath.Ext(event.Name) == ".yml" {
-				envName := filepath.Base(filepath.Dir(event.Name))
-				if err := m.loadEnvironment(envName); err != nil {
-					log.Printf("Error reloading environment %s: %v", envName, err)
-				}
+			// A change to a global role affects every customer
+			if customer == globalRolesDir {
+				m.reloadAll()
+				continue
+			}
+			if err := m.loadCustomer(customer); err != nil {
+				log.Printf("Error reloading environments for customer %s: %v", customer, err)
 			}
 
 		case err, ok := <-m.watcher.Errors:
@@ -156,31 +416,42 @@ func (m *EnvironmentManager) watchEnvironments() {
 	}
 }
 
-func (m *EnvironmentManager) GetPlaybooksForHost(hostname string) []models.Task {
-	var tasks []models.Task
+func (m *EnvironmentManager) reloadAll() {
 	m.mutex.RLock()
-	defer m.mutex.RUnlock()
+	customers := make([]string, 0, len(m.environments))
+	for customer := range m.environments {
+		customers = append(customers, customer)
+	}
+	m.mutex.RUnlock()
 
-	for _, playbooks := range m.environments {
-		for _, playbook := range playbooks {
-			for _, task := range playbook.Tasks {
-				if task.When == "" || task.When == hostname {
-					tasks = append(tasks, task)
-				}
-			}
+	for _, customer := range customers {
+		if err := m.loadCustomer(customer); err != nil {
+			log.Printf("Error reloading environments for customer %s: %v", customer, err)
 		}
 	}
+}
+
+// GetEnvironment returns the resolved environment of a customer, or nil if
+// there is none with that name.
+func (m *EnvironmentManager) GetEnvironment(customer, environment string) *ResolvedEnvironment {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 
-	return tasks
+	for _, env := range m.environments[customer] {
+		if env.Matches(environment) {
+			return env
+		}
+	}
+	return nil
 }
 
-func (m *EnvironmentManager) GetEnvironments() map[string][]models.Playbook {
+func (m *EnvironmentManager) GetEnvironments() map[string][]*ResolvedEnvironment {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
-	environments := make(map[string][]models.Playbook, len(m.environments))
-	for env, playbooks := range m.environments {
-		environments[env] = playbooks
+	environments := make(map[string][]*ResolvedEnvironment, len(m.environments))
+	for customer, envs := range m.environments {
+		environments[customer] = envs
 	}
 
 	return environments
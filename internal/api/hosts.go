@@ -0,0 +1,74 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// HostPattern is a compiled list of playbook host patterns. A host matches
+// if it matches any plain pattern, every pattern prefixed with & and none of
+// the patterns prefixed with !. For example
+//
+//	hosts: ["prod-db-*", "&*.customer1.local", "!prod-db-03*"]
+//
+// targets all prod-db hosts in customer1.local except prod-db-03. An empty
+// list, or one with only & and ! patterns, starts from all hosts.
+type HostPattern struct {
+	include []glob.Glob
+	require []glob.Glob
+	exclude []glob.Glob
+}
+
+// CompileHostPattern compiles the hosts list of a playbook.
+func CompileHostPattern(patterns []string) (*HostPattern, error) {
+	p := &HostPattern{}
+	for _, pattern := range patterns {
+		target := &p.include
+		switch {
+		case strings.HasPrefix(pattern, "!"):
+			target = &p.exclude
+			pattern = pattern[1:]
+		case strings.HasPrefix(pattern, "&"):
+			target = &p.require
+			pattern = pattern[1:]
+		}
+
+		if pattern == "" {
+			return nil, fmt.Errorf("empty host pattern")
+		}
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %v", pattern, err)
+		}
+		*target = append(*target, g)
+	}
+	return p, nil
+}
+
+// Match reports whether hostname is targeted by the pattern.
+func (p *HostPattern) Match(hostname string) bool {
+	if p == nil {
+		return true
+	}
+
+	if len(p.include) > 0 && !matchAny(p.include, hostname) {
+		return false
+	}
+	for _, g := range p.require {
+		if !g.Match(hostname) {
+			return false
+		}
+	}
+	return !matchAny(p.exclude, hostname)
+}
+
+func matchAny(globs []glob.Glob, hostname string) bool {
+	for _, g := range globs {
+		if g.Match(hostname) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/diceone/for-IT/internal/models"
+	"gopkg.in/yaml.v3"
+)
+
+// expandIncludes returns the tasks of every file included by playbook,
+// recursively, followed by the playbook's own tasks. path is the file the
+// playbook was read from and chain lists the files currently being expanded,
+// which is used to detect include cycles. Every included file is recorded in
+// deps so that changes to it can trigger a reload.
+func (s *Server) expandIncludes(path string, playbook models.Playbook, chain []string, deps map[string]bool) ([]models.Task, error) {
+	var tasks []models.Task
+	for _, include := range playbook.Include {
+		includePath, err := s.resolveInclude(path, include)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, p := range chain {
+			if p == includePath {
+				cycle := append(append([]string{}, chain[i:]...), includePath)
+				for j := range cycle {
+					cycle[j] = s.displayPath(cycle[j])
+				}
+				return nil, fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+			}
+		}
+		deps[includePath] = true
+
+		data, err := os.ReadFile(includePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read include %s: %v", s.displayPath(includePath), err)
+		}
+
+		var included models.Playbook
+		if err := yaml.Unmarshal(data, &included); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal include %s: %v", s.displayPath(includePath), err)
+		}
+
+		next := append(chain[:len(chain):len(chain)], includePath)
+		includedTasks, err := s.expandIncludes(includePath, included, next, deps)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, includedTasks...)
+	}
+
+	if err := validateTasks(s.displayPath(path), playbook.Tasks); err != nil {
+		return nil, err
+	}
+	return append(tasks, playbook.Tasks...), nil
+}
+
+// resolveInclude finds the file referenced by an include directive. Relative
+// paths are looked up next to the including file first, then below the
+// playbook directory and then below the environments directory, so that
+// flat playbooks can include the tasks of roles.
+func (s *Server) resolveInclude(from, include string) (string, error) {
+	candidates := []string{include}
+	if !filepath.IsAbs(include) {
+		candidates = []string{
+			filepath.Join(filepath.Dir(from), include),
+			filepath.Join(s.playbookDir, include),
+		}
+		if s.environments != nil {
+			candidates = append(candidates, filepath.Join(s.environments.baseDir, include))
+		}
+	}
+
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return filepath.Clean(candidate), nil
+		}
+	}
+
+	return "", fmt.Errorf("include %s of %s not found (tried %s)",
+		include, s.displayPath(from), strings.Join(candidates, ", "))
+}
+
+// inPlaybookDir reports whether path lies below the playbook directory.
+func (s *Server) inPlaybookDir(path string) bool {
+	rel, err := filepath.Rel(s.playbookDir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// displayPath shortens paths below the playbook directory for log and error
+// messages.
+func (s *Server) displayPath(path string) string {
+	if s.inPlaybookDir(path) {
+		rel, _ := filepath.Rel(s.playbookDir, path)
+		return rel
+	}
+	return path
+}
+
+// dependents returns the playbooks that include the given file.
+func (s *Server) dependents(path string) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var playbooks []string
+	for filename, playbook := range s.playbooks {
+		if playbook.includes[path] {
+			playbooks = append(playbooks, filename)
+		}
+	}
+	return playbooks
+}
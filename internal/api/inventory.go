@@ -18,6 +18,9 @@ type InventoryEntry struct {
 	LastSeen    time.Time `json:"last_seen"`
 	FirstSeen   time.Time `json:"first_seen"`
 	Environment string    `json:"environment,omitempty"`
+	// Facts are the latest facts reported by the client
+	Facts        map[string]interface{} `json:"facts,omitempty"`
+	FactsUpdated time.Time              `json:"facts_updated,omitempty"`
 }
 
 // InventoryManager handles the server's inventory of clients
@@ -54,6 +57,28 @@ func (im *InventoryManager) UpdateClient(hostname, remoteAddr string) error {
 	im.mu.Lock()
 	defer im.mu.Unlock()
 
+	im.entries[hostname] = im.touch(hostname, remoteAddr)
+
+	return im.save()
+}
+
+// UpdateFacts stores the facts reported by a client, replacing the previous
+// ones, and updates the client's entry like UpdateClient
+func (im *InventoryManager) UpdateFacts(hostname, remoteAddr string, facts map[string]interface{}) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	entry := im.touch(hostname, remoteAddr)
+	entry.Facts = facts
+	entry.FactsUpdated = entry.LastSeen
+	im.entries[hostname] = entry
+
+	return im.save()
+}
+
+// touch returns the entry of a client with its IP and last seen time
+// updated. The caller must hold the lock.
+func (im *InventoryManager) touch(hostname, remoteAddr string) InventoryEntry {
 	// Extract IP from remoteAddr (removes port)
 	ip, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
@@ -74,9 +99,19 @@ func (im *InventoryManager) UpdateClient(hostname, remoteAddr string) error {
 	}
 	
 	entry.LastSeen = now
-	im.entries[hostname] = entry
+	return entry
+}
 
-	return im.save()
+// GetFacts returns the latest facts of a client
+func (im *InventoryManager) GetFacts(hostname string) (map[string]interface{}, bool) {
+	im.mu.RLock()
+	defer im.mu.RUnlock()
+
+	entry, ok := im.entries[hostname]
+	if !ok || entry.Facts == nil {
+		return nil, false
+	}
+	return entry.Facts, true
 }
 
 // GetInventory returns all inventory entries
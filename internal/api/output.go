@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"strings"
 	"time"
+
+	"github.com/diceone/for-IT/internal/models"
 )
 
 const (
@@ -15,19 +17,8 @@ const (
 	ColorCyan   = "\033[36m"
 )
 
-type TaskResult struct {
-	Name       string
-	Status     string
-	Changed    bool
-	Failed     bool
-	SkipReason string
-	Duration   time.Duration
-	Output     string
-	Error      string
-}
-
 // formatTaskOutput formats task output in Ansible-like style
-func formatTaskOutput(taskName string, result TaskResult, dryRun bool) string {
+func formatTaskOutput(taskName string, result models.TaskResult, dryRun bool) string {
 	var status, color string
 	indent := "        "
 
@@ -68,11 +59,27 @@ func formatTaskOutput(taskName string, result TaskResult, dryRun bool) string {
 		ColorReset,
 	)
 
-	// Format output if present
+	// Format output if present. The output of commands is their stdout,
+	// which is shown separately together with stderr
 	var outputLines []string
-	if result.Output != "" || result.Error != "" {
+	if result.Command != "" {
+		outputLines = append(outputLines, fmt.Sprintf("%sCommand: %s", indent, result.Command))
+	}
+	for _, stream := range []struct{ name, text string }{{"Stdout", result.Stdout}, {"Stderr", result.Stderr}} {
+		if stream.text == "" {
+			continue
+		}
+		outputLines = append(outputLines, fmt.Sprintf("%s%s:", indent, stream.name))
+		for _, line := range strings.Split(stream.text, "\n") {
+			outputLines = append(outputLines, fmt.Sprintf("%s  %s", indent, line))
+		}
+	}
+	if result.OutputFile != "" {
+		outputLines = append(outputLines, fmt.Sprintf("%sFull output: %s", indent, result.OutputFile))
+	}
+	if (result.Output != "" && result.Output != result.Stdout) || result.Error != "" {
 		outputLines = append(outputLines, fmt.Sprintf("%sOutput:", indent))
-		if result.Output != "" {
+		if result.Output != "" && result.Output != result.Stdout {
 			for _, line := range strings.Split(result.Output, "\n") {
 				if line != "" {
 					outputLines = append(outputLines, fmt.Sprintf("%s  %s", indent, line))
@@ -97,7 +104,7 @@ func formatTaskOutput(taskName string, result TaskResult, dryRun bool) string {
 	return strings.Join(parts, "\n")
 }
 
-func formatResultDetails(result TaskResult, dryRun bool) string {
+func formatResultDetails(result models.TaskResult, dryRun bool) string {
 	var details []string
 
 	if dryRun {
@@ -115,6 +122,19 @@ func formatResultDetails(result TaskResult, dryRun bool) string {
 	if result.SkipReason != "" {
 		details = append(details, fmt.Sprintf("\"skip_reason\": \"%s\"", result.SkipReason))
 	}
+
+	if result.ExitCode != nil {
+		details = append(details, fmt.Sprintf("\"exit_code\": %d", *result.ExitCode))
+	}
+
+	if result.TimedOut {
+		details = append(details, "\"timed_out\": true")
+	}
+
+	if !result.StartedAt.IsZero() {
+		details = append(details, fmt.Sprintf("\"started_at\": \"%s\"", result.StartedAt.Format(time.RFC3339)))
+		details = append(details, fmt.Sprintf("\"ended_at\": \"%s\"", result.EndedAt.Format(time.RFC3339)))
+	}
 	
 	details = append(details, fmt.Sprintf("\"duration\": %.2fs", result.Duration.Seconds()))
 
@@ -122,7 +142,7 @@ func formatResultDetails(result TaskResult, dryRun bool) string {
 }
 
 // formatPlaybookSummary formats the final playbook summary in Ansible style
-func formatPlaybookSummary(results []TaskResult, duration time.Duration, dryRun bool) string {
+func formatPlaybookSummary(results []models.TaskResult, duration time.Duration, dryRun bool) string {
 	var ok, changed, failed, skipped int
 	
 	for _, result := range results {
@@ -139,7 +159,7 @@ func formatPlaybookSummary(results []TaskResult, duration time.Duration, dryRun
 	}
 
 	header := "\nPLAY RECAP *********************************************************************"
-	recap := fmt.Sprintf("localhost                  : %sok=%d    changed=%d    failed=%d    skipped=%d%s",
+	recap := fmt.Sprintf("localhost                  : %sok=%d    %schanged=%d    %sfailed=%d    %sskipped=%d%s",
 		ColorGreen, ok,
 		ColorYellow, changed,
 		ColorRed, failed,
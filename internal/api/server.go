@@ -2,37 +2,55 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
+	"github.com/diceone/for-IT/internal/condition"
 	"github.com/diceone/for-IT/internal/models"
+	"github.com/diceone/for-IT/internal/vars"
 	"github.com/fsnotify/fsnotify"
 	"gopkg.in/yaml.v3"
 )
 
+// loadedPlaybook is a flat playbook together with the state derived from it
+// when it was loaded.
+type loadedPlaybook struct {
+	models.Playbook
+	targets  *HostPattern
+	includes map[string]bool
+}
+
 type Server struct {
-	playbookDir string
-	playbooks   map[string]models.Playbook
-	mutex       sync.RWMutex
-	watcher     *fsnotify.Watcher
+	playbookDir  string
+	playbooks    map[string]*loadedPlaybook
+	environments *EnvironmentManager
+	inventory    *InventoryManager
+	spool        *SpoolManager
+	mutex        sync.RWMutex
+	watcher      *fsnotify.Watcher
 }
 
-func NewServer(playbookDir string) (*Server, error) {
+func NewServer(playbookDir string, environments *EnvironmentManager, inventory *InventoryManager, spool *SpoolManager) (*Server, error) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create watcher: %v", err)
 	}
 
 	s := &Server{
-		playbookDir: playbookDir,
-		playbooks:   make(map[string]models.Playbook),
-		watcher:     watcher,
+		playbookDir:  playbookDir,
+		playbooks:    make(map[string]*loadedPlaybook),
+		environments: environments,
+		inventory:    inventory,
+		spool:        spool,
+		watcher:      watcher,
 	}
 
 	if err := s.loadPlaybooks(); err != nil {
@@ -45,6 +63,10 @@ func NewServer(playbookDir string) (*Server, error) {
 }
 
 func (s *Server) loadPlaybooks() error {
+	if err := os.MkdirAll(s.playbookDir, 0755); err != nil {
+		return fmt.Errorf("failed to create playbook directory: %v", err)
+	}
+
 	err := filepath.Walk(s.playbookDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -83,12 +105,37 @@ func (s *Server) loadPlaybook(filename string) error {
 		return fmt.Errorf("failed to unmarshal playbook: %v", err)
 	}
 
+	targets, err := CompileHostPattern(playbook.Hosts)
+	if err != nil {
+		return fmt.Errorf("hosts: %v", err)
+	}
+
+	// Included tasks run before the playbook's own tasks
+	deps := make(map[string]bool)
+	playbook.Tasks, err = s.expandIncludes(path, playbook, []string{path}, deps)
+	if err != nil {
+		return err
+	}
+
 	s.mutex.Lock()
-	s.playbooks[filename] = playbook
+	s.playbooks[filename] = &loadedPlaybook{
+		Playbook: playbook,
+		targets:  targets,
+		includes: deps,
+	}
 	s.mutex.Unlock()
 
-	log.Printf("Loaded playbook %s: customer=%s, environment=%s, tasks=%d", 
-		filename, playbook.Customer, playbook.Environment, len(playbook.Tasks))
+	// Included files outside the playbook directory need their own watch
+	for dep := range deps {
+		if !s.inPlaybookDir(dep) {
+			if err := s.watcher.Add(filepath.Dir(dep)); err != nil {
+				log.Printf("Error watching include directory %s: %v", filepath.Dir(dep), err)
+			}
+		}
+	}
+
+	log.Printf("Loaded playbook %s: customer=%s, environment=%s, tasks=%d, includes=%d", 
+		filename, playbook.Customer, playbook.Environment, len(playbook.Tasks), len(deps))
 	return nil
 }
 
@@ -130,17 +177,27 @@ func (s *Server) watchPlaybooks() {
 				continue
 			}
 
-			switch event.Op {
-			case fsnotify.Write, fsnotify.Create:
-				log.Printf("Playbook modified: %s", relPath)
-				if err := s.loadPlaybook(relPath); err != nil {
-					log.Printf("Error reloading playbook %s: %v", relPath, err)
+			if s.inPlaybookDir(event.Name) {
+				switch event.Op {
+				case fsnotify.Write, fsnotify.Create:
+					log.Printf("Playbook modified: %s", relPath)
+					if err := s.loadPlaybook(relPath); err != nil {
+						log.Printf("Error reloading playbook %s: %v", relPath, err)
+					}
+				case fsnotify.Remove, fsnotify.Rename:
+					log.Printf("Playbook removed: %s", relPath)
+					s.mutex.Lock()
+					delete(s.playbooks, relPath)
+					s.mutex.Unlock()
+				}
+			}
+
+			// Reload every playbook that includes the changed file
+			for _, dependent := range s.dependents(filepath.Clean(event.Name)) {
+				log.Printf("Include %s of playbook %s changed", s.displayPath(event.Name), dependent)
+				if err := s.loadPlaybook(dependent); err != nil {
+					log.Printf("Error reloading playbook %s: %v", dependent, err)
 				}
-			case fsnotify.Remove, fsnotify.Rename:
-				log.Printf("Playbook removed: %s", relPath)
-				s.mutex.Lock()
-				delete(s.playbooks, relPath)
-				s.mutex.Unlock()
 			}
 
 		case err, ok := <-s.watcher.Errors:
@@ -155,6 +212,10 @@ func (s *Server) watchPlaybooks() {
 func (s *Server) Start(addr string) error {
 	http.HandleFunc("/tasks", s.handleTasks)
 	http.HandleFunc("/results", s.handleResults)
+	http.HandleFunc("/facts", s.handleFacts)
+	http.HandleFunc("/files", s.handleFiles)
+	http.HandleFunc("/spool", s.handleSpool)
+	http.HandleFunc("/spool/requests", s.handleSpoolRequests)
 	return http.ListenAndServe(addr, nil)
 }
 
@@ -182,15 +243,60 @@ func (s *Server) handleTasks(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.inventory != nil {
+		if err := s.inventory.UpdateClient(hostname, r.RemoteAddr); err != nil {
+			log.Printf("Error updating inventory for %s: %v", hostname, err)
+		}
+	}
+
+	// Environment files (dev.yml, prod.yml, ...) come first, followed by any
+	// flat playbooks addressed to the same customer and environment. Only
+	// playbooks whose hosts patterns match the requesting host are included.
 	var tasks []models.Task
+	scope := vars.Scope{}
+	policy := ""
+	if s.environments != nil {
+		if env := s.environments.GetEnvironment(customer, environment); env != nil {
+			for _, playbook := range env.Playbooks {
+				if playbook.Targets.Match(hostname) {
+					tasks = append(tasks, playbook.Tasks...)
+				}
+			}
+			scope = vars.NewScope(env.Environment)
+			policy = env.Environment.PackageManagerDefaults
+		}
+	}
+	scope["hostname"] = hostname
+	if s.inventory != nil {
+		if facts, ok := s.inventory.GetFacts(hostname); ok {
+			scope["facts"] = facts
+		}
+	}
+
 	s.mutex.RLock()
-	for _, playbook := range s.playbooks {
-		if playbook.Customer == customer && playbook.Environment == environment {
+	filenames := make([]string, 0, len(s.playbooks))
+	for filename := range s.playbooks {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	for _, filename := range filenames {
+		playbook := s.playbooks[filename]
+		if playbook.Customer == customer && playbook.Environment == environment && playbook.targets.Match(hostname) {
 			tasks = append(tasks, playbook.Tasks...)
 		}
 	}
 	s.mutex.RUnlock()
 
+	tasks, err := renderTasks(tasks, scope)
+	if err != nil {
+		log.Printf("Error rendering tasks for %s (customer=%s, environment=%s): %v", hostname, customer, environment, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The client applies the command policy; a task's own setting wins
+	setPolicy(tasks, policy)
+
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(tasks); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to encode tasks: %v", err), http.StatusInternalServerError)
@@ -198,6 +304,357 @@ func (s *Server) handleTasks(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// setPolicy sets the command policy of tasks and of the tasks of their blocks
+// that do not set their own.
+func setPolicy(tasks []models.Task, policy string) {
+	for i := range tasks {
+		if tasks[i].PackageManagerDefaults == "" {
+			tasks[i].PackageManagerDefaults = policy
+		}
+		setPolicy(tasks[i].Block, policy)
+		setPolicy(tasks[i].Rescue, policy)
+		setPolicy(tasks[i].Always, policy)
+	}
+}
+
+// renderTasks interpolates variables into the command, environment and module
+// arguments of every task. The tasks are copied so the loaded playbooks stay
+// untouched. References to the results registered by earlier tasks are left
+// for the client to render.
+func renderTasks(tasks []models.Task, scope vars.Scope) ([]models.Task, error) {
+	// Registered results shadow the variables of the environment
+	runScope := make(vars.Scope, len(scope))
+	for name, value := range scope {
+		runScope[name] = value
+	}
+	return renderTaskList(tasks, scope, runScope)
+}
+
+// renderTaskList renders tasks in the order the client runs them, including
+// the tasks of blocks, and adds the names they register to runScope.
+func renderTaskList(tasks []models.Task, scope, runScope vars.Scope) ([]models.Task, error) {
+	rendered := make([]models.Task, 0, len(tasks))
+	for _, original := range tasks {
+		if original.Block != nil {
+			block, err := renderBlock(original, scope, runScope)
+			if err != nil {
+				return nil, err
+			}
+			rendered = append(rendered, block)
+			continue
+		}
+
+		// The client fills in the item and index of a loop for every item
+		taskScope := runScope
+		if original.Loop != nil {
+			items, err := loopItems(original.Loop, runScope)
+			if err != nil {
+				return nil, fmt.Errorf("task %q: loop: %v", original.Name, err)
+			}
+			original.Loop = items
+			taskScope = make(vars.Scope, len(runScope)+2)
+			for name, value := range runScope {
+				taskScope[name] = value
+			}
+			taskScope["item"] = vars.Deferred{}
+			taskScope["index"] = vars.Deferred{}
+		}
+
+		task, err := vars.RenderTask(original, taskScope)
+		if errors.Is(err, vars.ErrDeferred) {
+			task, err = vars.DeferTask(original, taskScope)
+			task.Deferred = true
+		}
+		if err != nil {
+			return nil, fmt.Errorf("task %q: %v", original.Name, err)
+		}
+
+		if task.Vars, err = conditionVars(task, scope); err != nil {
+			return nil, fmt.Errorf("task %q: %v", task.Name, err)
+		}
+		// Templates are rendered by the client and may use any variable
+		if task.Template != nil {
+			task.Vars = templateVars(scope)
+		}
+
+		rendered = append(rendered, task)
+		if task.Register != "" {
+			runScope[task.Register] = vars.Deferred{}
+		}
+	}
+	return rendered, nil
+}
+
+// renderBlock renders the tasks of a block. They get the variables of the
+// block unless they set them themselves.
+func renderBlock(block models.Task, scope, runScope vars.Scope) (models.Task, error) {
+	var err error
+	if block.Vars, err = conditionVars(block, scope); err != nil {
+		return block, fmt.Errorf("block %q: %v", block.Name, err)
+	}
+	for _, tasks := range []*[]models.Task{&block.Block, &block.Rescue, &block.Always} {
+		inherited := make([]models.Task, len(*tasks))
+		for i, task := range *tasks {
+			inherited[i] = task
+			if len(block.Variables) == 0 {
+				continue
+			}
+			variables := make(map[string]string, len(block.Variables)+len(task.Variables))
+			for name, value := range block.Variables {
+				variables[name] = value
+			}
+			for name, value := range task.Variables {
+				variables[name] = value
+			}
+			inherited[i].Variables = variables
+		}
+		if *tasks, err = renderTaskList(inherited, scope, runScope); err != nil {
+			return block, err
+		}
+	}
+	// The variables are rendered as part of the tasks
+	block.Variables = nil
+	return block, nil
+}
+
+// conditionVars returns the variables referenced by the conditions of a task.
+// The client evaluates the conditions, so the server sends these along.
+// Facts are gathered by the client itself.
+func conditionVars(task models.Task, scope vars.Scope) (map[string]interface{}, error) {
+	var refs []string
+	for key, src := range task.Conditions() {
+		expr, err := condition.Parse(src)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		refs = append(refs, expr.Refs()...)
+	}
+	return referencedVars(refs, scope), nil
+}
+
+// loopItems resolves the loop of a task to its list of items. A map is looped
+// over by its entries, sorted by key, as items with a key and a value.
+func loopItems(loop interface{}, scope vars.Scope) ([]interface{}, error) {
+	if ref, ok := loop.(string); ok {
+		match := loopReference.FindStringSubmatch(ref)
+		if match == nil {
+			return nil, fmt.Errorf("loop %q is not a single ${...} reference", ref)
+		}
+		path := match[1]
+		root, _, _ := strings.Cut(path, ".")
+		if _, ok := scope[root].(vars.Deferred); ok {
+			return nil, fmt.Errorf("cannot loop over the registered result %s", root)
+		}
+		value, ok := scope.Lookup(path)
+		if !ok {
+			return nil, fmt.Errorf("undefined variable %q", path)
+		}
+		loop = value
+	} else {
+		rendered, err := vars.RenderAll(loop, scope)
+		if err != nil {
+			return nil, err
+		}
+		loop = rendered
+	}
+
+	switch v := loop.(type) {
+	case []interface{}:
+		return v, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		items := make([]interface{}, 0, len(keys))
+		for _, key := range keys {
+			items = append(items, map[string]interface{}{"key": key, "value": v[key]})
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("value of type %T is not a list or a map", loop)
+}
+
+// referencedVars returns the top-level scope entries needed to resolve refs.
+// The hostname and facts are left out as the client knows them best.
+func referencedVars(refs []string, scope vars.Scope) map[string]interface{} {
+	var referenced map[string]interface{}
+	for _, ref := range refs {
+		root, _, _ := strings.Cut(ref, ".")
+		if root == "hostname" || root == "facts" {
+			continue
+		}
+		if value, ok := scope[root]; ok {
+			if referenced == nil {
+				referenced = make(map[string]interface{})
+			}
+			referenced[root] = value
+		}
+	}
+	return referenced
+}
+
+// templateVars returns the scope without the hostname and facts, which the
+// client adds itself.
+func templateVars(scope vars.Scope) map[string]interface{} {
+	values := make(map[string]interface{}, len(scope))
+	for name, value := range scope {
+		if name != "hostname" && name != "facts" {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// handleFiles serves the files of a role to clients, e.g. for the source of
+// a file task.
+func (s *Server) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.environments == nil {
+		http.Error(w, "Environments are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	path, err := s.environments.RoleFile(query.Get("role"), query.Get("dir"), query.Get("path"))
+	if os.IsNotExist(err) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	http.ServeFile(w, r, path)
+}
+
+// handleFacts stores the facts a client reports with POST and returns the
+// stored facts of a host with GET.
+func (s *Server) handleFacts(w http.ResponseWriter, r *http.Request) {
+	hostname := r.URL.Query().Get("hostname")
+	if hostname == "" {
+		http.Error(w, "Hostname is required", http.StatusBadRequest)
+		return
+	}
+
+	if s.inventory == nil {
+		http.Error(w, "Inventory is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		facts, ok := s.inventory.GetFacts(hostname)
+		if !ok {
+			http.Error(w, "No facts for host", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(facts); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to encode facts: %v", err), http.StatusInternalServerError)
+		}
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var facts map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&facts); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to unmarshal facts: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := s.inventory.UpdateFacts(hostname, r.RemoteAddr, facts); err != nil {
+			log.Printf("Error storing facts for %s: %v", hostname, err)
+			http.Error(w, fmt.Sprintf("Failed to store facts: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Updated facts for %s (%d facts)", hostname, len(facts))
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSpool returns the full output of a command with GET. A file the
+// client has not uploaded yet is requested from it, and the response is
+// 202 Accepted until the client uploaded it with POST on its next check.
+// Uploads of files the client was not asked for are rejected.
+func (s *Server) handleSpool(w http.ResponseWriter, r *http.Request) {
+	if s.spool == nil {
+		http.Error(w, "Spool is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	hostname := r.URL.Query().Get("hostname")
+	file := r.URL.Query().Get("file")
+	if err := validateSpoolFile(hostname, file); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if path := s.spool.Path(hostname, file); path != "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			http.ServeFile(w, r, path)
+			return
+		}
+		s.spool.Request(hostname, file)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Requested %s from %s, it is uploaded on the client's next check\n", file, hostname)
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		err := s.spool.Store(hostname, file, r.Body)
+		if err == errSpoolNotRequested {
+			log.Printf("Rejected spool file %s of %s: %v", file, hostname, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			log.Printf("Error storing spool file %s of %s: %v", file, hostname, err)
+			http.Error(w, fmt.Sprintf("Failed to store spool file: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Stored spool file %s of %s", file, hostname)
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSpoolRequests returns the spool files requested from a client.
+func (s *Server) handleSpoolRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	hostname := r.URL.Query().Get("hostname")
+	if hostname == "" {
+		http.Error(w, "Hostname is required", http.StatusBadRequest)
+		return
+	}
+
+	files := []string{}
+	if s.spool != nil {
+		files = s.spool.TakeRequests(hostname)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(files); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode spool requests: %v", err), http.StatusInternalServerError)
+	}
+}
+
 func (s *Server) handleResults(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -221,6 +678,28 @@ func (s *Server) handleResults(w http.ResponseWriter, r *http.Request) {
 	for _, result := range results {
 		log.Printf("Task: %s, Changed: %v, Failed: %v, Output: %s", 
 			result.Name, result.Changed, result.Failed, result.Output)
+		if result.Failed {
+			exitCode := "none"
+			if result.ExitCode != nil {
+				exitCode = fmt.Sprint(*result.ExitCode)
+			}
+			log.Printf("Task: %s, Error: %s, Exit code: %s, Stderr: %s",
+				result.Name, result.Error, exitCode, result.Stderr)
+			if result.Rescued {
+				log.Printf("Task: %s, Rescued by its block", result.Name)
+			}
+		}
+		for _, item := range result.Results {
+			if !item.Failed {
+				continue
+			}
+			exitCode := "none"
+			if item.ExitCode != nil {
+				exitCode = fmt.Sprint(*item.ExitCode)
+			}
+			log.Printf("Task: %s, Item: %v, Error: %s, Exit code: %s, Stderr: %s",
+				result.Name, item.Item, item.Error, exitCode, item.Stderr)
+		}
 	}
 
 	w.WriteHeader(http.StatusOK)
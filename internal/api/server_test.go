@@ -0,0 +1,50 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/diceone/for-IT/internal/vars"
+)
+
+func TestLoopItems(t *testing.T) {
+	scope := vars.Scope{
+		"APP":      "shop",
+		"web":      map[string]interface{}{"hosts": []interface{}{"a", "b"}, "opts": map[string]interface{}{"y": 2, "x": 1}},
+		"result":   vars.Deferred{},
+		"hostname": "web-01",
+	}
+	tests := []struct {
+		loop interface{}
+		want []interface{}
+		err  string
+	}{
+		{loop: []interface{}{"${APP}-db", 1}, want: []interface{}{"shop-db", 1}},
+		{loop: "${web.hosts}", want: []interface{}{"a", "b"}},
+		{loop: "${ web.opts }", want: []interface{}{
+			map[string]interface{}{"key": "x", "value": 1},
+			map[string]interface{}{"key": "y", "value": 2},
+		}},
+		{loop: "${web.missing}", err: `undefined variable "web.missing"`},
+		{loop: "${result.results}", err: "cannot loop over the registered result result"},
+		{loop: "${APP}", err: "value of type string is not a list or a map"},
+		{loop: "web-${APP}", err: "is not a single ${...} reference"},
+	}
+	for _, tt := range tests {
+		got, err := loopItems(tt.loop, scope)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("loopItems(%v) error = %v, want %q", tt.loop, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("loopItems(%v): %v", tt.loop, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("loopItems(%v) = %v, want %v", tt.loop, got, tt.want)
+		}
+	}
+}
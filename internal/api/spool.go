@@ -0,0 +1,164 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// spoolName matches the names of spool files and the hostnames they are
+// stored under, so that neither can lead out of the spool directory.
+var spoolName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// maxSpoolSize limits the size of an uploaded spool file.
+const maxSpoolSize = 256 << 20
+
+// spoolUploadTimeout is how long the server accepts the upload of a spool
+// file after it asked the client for it.
+const spoolUploadTimeout = time.Hour
+
+// errSpoolNotRequested is returned by Store for a file the server did not
+// ask the client for.
+var errSpoolNotRequested = errors.New("spool file was not requested")
+
+// SpoolManager keeps the full output of commands that clients upload on
+// request. Clients only hold on to the full output of commands whose output
+// was truncated in their results; the server asks for a file when someone
+// fetches it and the client uploads it on its next check.
+type SpoolManager struct {
+	dir       string
+	requested map[string]map[string]bool      // hostname -> files
+	pending   map[string]map[string]time.Time // hostname -> file -> asked at
+	mu        sync.Mutex
+}
+
+// NewSpoolManager creates a spool manager storing files below dataDir.
+func NewSpoolManager(dataDir string) (*SpoolManager, error) {
+	dir := filepath.Join(dataDir, "spool")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %v", err)
+	}
+	return &SpoolManager{
+		dir:       dir,
+		requested: make(map[string]map[string]bool),
+		pending:   make(map[string]map[string]time.Time),
+	}, nil
+}
+
+func validateSpoolFile(hostname, file string) error {
+	if !spoolName.MatchString(hostname) {
+		return fmt.Errorf("invalid hostname %q", hostname)
+	}
+	if !spoolName.MatchString(file) {
+		return fmt.Errorf("invalid file name %q", file)
+	}
+	return nil
+}
+
+// Path returns the path of a stored spool file, or "" if the client has not
+// uploaded it yet.
+func (sm *SpoolManager) Path(hostname, file string) string {
+	path := filepath.Join(sm.dir, hostname, file)
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	return path
+}
+
+// Request asks the client for a spool file on its next check.
+func (sm *SpoolManager) Request(hostname, file string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.requested[hostname] == nil {
+		sm.requested[hostname] = make(map[string]bool)
+	}
+	sm.requested[hostname][file] = true
+}
+
+// TakeRequests returns the files requested from a client and forgets them.
+// A file the client no longer has is thereby only asked for once. The
+// upload of the returned files is accepted for spoolUploadTimeout.
+func (sm *SpoolManager) TakeRequests(hostname string) []string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	now := time.Now()
+	pending := sm.pending[hostname]
+	for file, asked := range pending {
+		if now.Sub(asked) > spoolUploadTimeout {
+			delete(pending, file)
+		}
+	}
+
+	files := make([]string, 0, len(sm.requested[hostname]))
+	for file := range sm.requested[hostname] {
+		files = append(files, file)
+		if pending == nil {
+			pending = make(map[string]time.Time)
+			sm.pending[hostname] = pending
+		}
+		pending[file] = now
+	}
+	delete(sm.requested, hostname)
+	if len(pending) == 0 {
+		delete(sm.pending, hostname)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// claim reports whether the client was asked for a file and has not
+// uploaded it yet. A file can only be claimed once per request.
+func (sm *SpoolManager) claim(hostname, file string) bool {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	asked, ok := sm.pending[hostname][file]
+	if !ok {
+		return false
+	}
+	delete(sm.pending[hostname], file)
+	if len(sm.pending[hostname]) == 0 {
+		delete(sm.pending, hostname)
+	}
+	return time.Since(asked) <= spoolUploadTimeout
+}
+
+// Store saves a spool file uploaded by a client. Only files the client was
+// asked for by TakeRequests are accepted, errSpoolNotRequested is returned
+// for any other file.
+func (sm *SpoolManager) Store(hostname, file string, r io.Reader) error {
+	if !sm.claim(hostname, file) {
+		return errSpoolNotRequested
+	}
+
+	dir := filepath.Join(sm.dir, hostname)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+file+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, io.LimitReader(r, maxSpoolSize+1))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(tmp.Name()); err == nil && info.Size() > maxSpoolSize {
+		return fmt.Errorf("spool file is larger than %d bytes", maxSpoolSize)
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, file))
+}
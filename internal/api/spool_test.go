@@ -0,0 +1,65 @@
+package api
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpoolStoreRequested(t *testing.T) {
+	sm, err := NewSpoolManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.Store("web-01", "out.log", strings.NewReader("unrequested")); err != errSpoolNotRequested {
+		t.Fatalf("unrequested upload: error = %v, want errSpoolNotRequested", err)
+	}
+	if sm.Path("web-01", "out.log") != "" {
+		t.Fatal("unrequested upload was stored")
+	}
+
+	// A request only allows the upload once the client has been asked
+	sm.Request("web-01", "out.log")
+	if err := sm.Store("web-01", "out.log", strings.NewReader("early")); err != errSpoolNotRequested {
+		t.Fatalf("upload before the client was asked: error = %v", err)
+	}
+	if files := sm.TakeRequests("web-01"); !reflect.DeepEqual(files, []string{"out.log"}) {
+		t.Fatalf("TakeRequests = %v, want [out.log]", files)
+	}
+	if err := sm.Store("db-01", "out.log", strings.NewReader("other host")); err != errSpoolNotRequested {
+		t.Fatalf("upload from another host: error = %v", err)
+	}
+	if err := sm.Store("web-01", "out.log", strings.NewReader("full output")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(sm.Path("web-01", "out.log")); string(data) != "full output" {
+		t.Errorf("stored file = %q, want %q", data, "full output")
+	}
+
+	// Each request allows a single upload
+	if err := sm.Store("web-01", "out.log", strings.NewReader("again")); err != errSpoolNotRequested {
+		t.Errorf("second upload: error = %v, want errSpoolNotRequested", err)
+	}
+}
+
+func TestSpoolUploadTimeout(t *testing.T) {
+	sm, err := NewSpoolManager(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Request("web-01", "old.log")
+	sm.TakeRequests("web-01")
+	sm.pending["web-01"]["old.log"] = time.Now().Add(-spoolUploadTimeout - time.Minute)
+
+	// Expired requests are dropped when the client checks in again
+	sm.TakeRequests("web-01")
+	if len(sm.pending) != 0 {
+		t.Errorf("expired requests were kept: %v", sm.pending)
+	}
+	if err := sm.Store("web-01", "old.log", strings.NewReader("late")); err != errSpoolNotRequested {
+		t.Errorf("late upload: error = %v, want errSpoolNotRequested", err)
+	}
+}
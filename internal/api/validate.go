@@ -0,0 +1,135 @@
+package api
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/diceone/for-IT/internal/condition"
+	"github.com/diceone/for-IT/internal/executor"
+	"github.com/diceone/for-IT/internal/models"
+	"github.com/diceone/for-IT/internal/modules"
+)
+
+// registerName matches the names tasks can register their results under. The
+// hostname and facts are reserved for the client.
+var registerName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// loopReference matches a loop given as a reference to a list or map, e.g.
+// ${mariadb.databases}.
+var loopReference = regexp.MustCompile(`^\$\{\s*([A-Za-z0-9_.-]+)\s*\}$`)
+
+// validateTasks checks the tasks loaded from file so that mistakes are
+// reported when the file is loaded rather than when a client runs it.
+func validateTasks(file string, tasks []models.Task) error {
+	for _, task := range tasks {
+		if task.Block != nil {
+			if err := validateBlock(file, task); err != nil {
+				return err
+			}
+			continue
+		}
+		if task.Rescue != nil || task.Always != nil {
+			key := "rescue"
+			if task.Rescue == nil {
+				key = "always"
+			}
+			return fmt.Errorf("%s:%d: task %q: %s is only allowed with block", file, task.KeyLine(key), task.Name, key)
+		}
+		if err := modules.Validate(task); err != nil {
+			return fmt.Errorf("%s:%d: task %q: %v", file, task.Line, task.Name, err)
+		}
+		if err := executor.ValidatePolicy(task.PackageManagerDefaults); err != nil {
+			return fmt.Errorf("%s:%d: task %q: package_manager_defaults: %v", file, task.KeyLine("package_manager_defaults"), task.Name, err)
+		}
+		if key, err := validateGuards(task); err != nil {
+			return fmt.Errorf("%s:%d: task %q: %s: %v", file, task.KeyLine(key), task.Name, key, err)
+		}
+		if task.Timeout != "" {
+			if timeout, err := time.ParseDuration(task.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("%s:%d: task %q: timeout must be a positive duration such as 90s or 10m, not %q", file, task.KeyLine("timeout"), task.Name, task.Timeout)
+			}
+		}
+		if task.Register != "" && (!registerName.MatchString(task.Register) || task.Register == "hostname" || task.Register == "facts") {
+			return fmt.Errorf("%s:%d: task %q: register: %q is not a valid variable name", file, task.KeyLine("register"), task.Name, task.Register)
+		}
+		if err := validateLoop(task.Loop); err != nil {
+			return fmt.Errorf("%s:%d: task %q: loop: %v", file, task.KeyLine("loop"), task.Name, err)
+		}
+		for key, src := range task.Conditions() {
+			if _, err := condition.Parse(src); err != nil {
+				return fmt.Errorf("%s:%d: task %q: %s: %v", file, task.KeyLine(key), task.Name, key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// blockKeys are the keys a block may have: its lists of tasks and what they
+// share.
+var blockKeys = map[string]bool{
+	"name": true, "description": true, "when": true, "variables": true,
+	"block": true, "rescue": true, "always": true,
+}
+
+// validateBlock checks a block and the tasks in it.
+func validateBlock(file string, block models.Task) error {
+	for _, key := range block.Keys() {
+		if !blockKeys[key] {
+			return fmt.Errorf("%s:%d: block %q: %s is not allowed in a block", file, block.KeyLine(key), block.Name, key)
+		}
+	}
+	if block.When != "" {
+		if _, err := condition.Parse(block.When); err != nil {
+			return fmt.Errorf("%s:%d: block %q: when: %v", file, block.KeyLine("when"), block.Name, err)
+		}
+	}
+	for _, tasks := range [][]models.Task{block.Block, block.Rescue, block.Always} {
+		if err := validateTasks(file, tasks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateLoop checks that a loop is a list, a map or a reference to one.
+func validateLoop(loop interface{}) error {
+	switch v := loop.(type) {
+	case nil, []interface{}, map[string]interface{}:
+		return nil
+	case string:
+		if loopReference.MatchString(v) {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be a list, a map or a single ${...} reference")
+}
+
+// validateGuards checks the guards of a task and returns the key of the one
+// that is invalid.
+func validateGuards(task models.Task) (string, error) {
+	paths := []struct{ key, path string }{{"creates", task.Creates}, {"removes", task.Removes}}
+	commands := []struct{ key, command string }{{"unless", task.Unless}, {"onlyif", task.OnlyIf}}
+
+	for _, guard := range paths {
+		if guard.path == "" {
+			continue
+		}
+		if task.Command == "" {
+			return guard.key, fmt.Errorf("only allowed with command")
+		}
+		if !filepath.IsAbs(guard.path) {
+			return guard.key, fmt.Errorf("must be an absolute path")
+		}
+		if _, err := filepath.Match(guard.path, ""); err != nil {
+			return guard.key, fmt.Errorf("invalid glob %q: %v", guard.path, err)
+		}
+	}
+	for _, guard := range commands {
+		if guard.command != "" && task.Command == "" {
+			return guard.key, fmt.Errorf("only allowed with command")
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,374 @@
+// Package condition implements the expression language used by task
+// conditions such as when:.
+//
+// Expressions combine comparisons with and/or/not (or &&, ||, !):
+//
+//	facts.os_family == "debian" and mariadb.port != 3306
+//	hostname matches "db-*" or not defined(mariadb.version)
+//	version(facts.distribution_version) >= "9.2"
+//	facts.kernel =~ "^6\\." && command 'rpm -q mariadb-server' exits 1
+//	rc in [0, 2] or stdout contains "already installed"
+//
+// Bare identifiers are references to variables; facts live under facts.*.
+// For backwards compatibility a single glob without spaces, such as "*" or
+// "web-*", is shorthand for hostname matches "<glob>".
+package condition
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// Env provides the values an expression is evaluated against.
+type Env interface {
+	// Lookup resolves a reference such as mariadb.port or facts.kernel.
+	Lookup(path string) (interface{}, bool)
+	// RunCommand runs a shell command and returns its exit code.
+	RunCommand(command string) (int, error)
+}
+
+// SyntaxError reports a parse error at a byte offset in the expression.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Pos+1, e.Msg)
+}
+
+// Expr is a parsed condition.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Parse parses a condition into its syntax tree.
+func Parse(src string) (*Expr, error) {
+	if pattern, ok := legacyGlob(src); ok {
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			return nil, &SyntaxError{Pos: 0, Msg: fmt.Sprintf("invalid glob %q: %v", pattern, err)}
+		}
+		root := &compareNode{op: "matches", left: &refNode{path: "hostname"}, right: &literalNode{value: pattern}, glob: g}
+		return &Expr{src: src, root: root}, nil
+	}
+
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected %q", tok.text)}
+	}
+
+	return &Expr{src: src, root: root}, nil
+}
+
+// legacyGlob reports whether src is a bare hostname glob such as "*".
+func legacyGlob(src string) (string, bool) {
+	src = strings.TrimSpace(src)
+	if src == "" || strings.ContainsAny(src, " \t\n\"'()") || !strings.ContainsAny(src, "*?[") {
+		return "", false
+	}
+	return src, true
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression and converts the result to a boolean.
+func (e *Expr) Eval(env Env) (bool, error) {
+	value, err := e.root.eval(env)
+	if err != nil {
+		return false, err
+	}
+	return truthy(value), nil
+}
+
+// Refs returns the references used by the expression, sorted and without
+// duplicates.
+func (e *Expr) Refs() []string {
+	seen := make(map[string]bool)
+	e.root.refs(seen)
+
+	refs := make([]string, 0, len(seen))
+	for ref := range seen {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is one of the given operators or
+// keywords.
+func (p *parser) accept(words ...string) (token, bool) {
+	tok := p.peek()
+	if tok.kind != tokOp && tok.kind != tokIdent {
+		return tok, false
+	}
+	for _, w := range words {
+		if tok.text == w {
+			p.pos++
+			return tok, true
+		}
+	}
+	return tok, false
+}
+
+func (p *parser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		tok := p.peek()
+		return &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("expected %q, found %s", op, describe(tok))}
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("or", "||"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{and: false, left: left, right: right}
+	}
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("and", "&&"); !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{and: true, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if _, ok := p.accept("not", "!"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+var comparisonOps = []string{"==", "!=", "<", "<=", ">", ">=", "=~", "!~", "matches", "in", "contains", "not"}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	tok, ok := p.accept(comparisonOps...)
+	if !ok {
+		return left, nil
+	}
+	op := tok.text
+	if op == "not" {
+		// "not in" is the only comparison starting with not
+		if err := p.expect("in"); err != nil {
+			return nil, err
+		}
+		op = "not in"
+	}
+
+	rightTok := p.peek()
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	cmp := &compareNode{op: op, left: left, right: right}
+	if lit, ok := right.(*literalNode); ok {
+		pattern, _ := lit.value.(string)
+		switch op {
+		case "=~", "!~":
+			if cmp.re, err = regexp.Compile(pattern); err != nil {
+				return nil, &SyntaxError{Pos: rightTok.pos, Msg: fmt.Sprintf("invalid regular expression: %v", err)}
+			}
+		case "matches":
+			if cmp.glob, err = glob.Compile(pattern); err != nil {
+				return nil, &SyntaxError{Pos: rightTok.pos, Msg: fmt.Sprintf("invalid glob %q: %v", pattern, err)}
+			}
+		}
+	}
+	return cmp, nil
+}
+
+func (p *parser) parseOperand() (node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokString:
+		return &literalNode{value: tok.text}, nil
+
+	case tokNumber:
+		return &literalNode{value: tok.value}, nil
+
+	case tokOp:
+		switch tok.text {
+		case "(":
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return inner, nil
+		case "[":
+			return p.parseList()
+		}
+
+	case tokIdent:
+		switch {
+		case tok.text == "true" || tok.text == "false":
+			return &literalNode{value: tok.text == "true"}, nil
+		case tok.text == "command" && p.peek().kind == tokString:
+			return p.parseCommand()
+		case p.peek().kind == tokOp && p.peek().text == "(":
+			return p.parseCall(tok)
+		case isKeyword(tok.text):
+			return nil, &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("unexpected keyword %q", tok.text)}
+		default:
+			return &refNode{path: tok.text}, nil
+		}
+	}
+
+	return nil, &SyntaxError{Pos: tok.pos, Msg: fmt.Sprintf("expected a value, found %s", describe(tok))}
+}
+
+func (p *parser) parseList() (node, error) {
+	list := &listNode{}
+	if _, ok := p.accept("]"); ok {
+		return list, nil
+	}
+	for {
+		item, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		list.items = append(list.items, item)
+
+		if _, ok := p.accept("]"); ok {
+			return list, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// parseCommand parses command '<shell command>' exits <code>.
+func (p *parser) parseCommand() (node, error) {
+	command := p.next()
+	if err := p.expect("exits"); err != nil {
+		return nil, err
+	}
+	code := p.next()
+	if code.kind != tokNumber || code.value != float64(int(code.value)) {
+		return nil, &SyntaxError{Pos: code.pos, Msg: fmt.Sprintf("expected an exit code, found %s", describe(code))}
+	}
+	return &commandNode{command: command.text, code: int(code.value)}, nil
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	p.next() // (
+	call := &callNode{name: name.text}
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if _, ok := p.accept(")"); ok {
+				break
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	switch call.name {
+	case "defined":
+		if len(call.args) != 1 {
+			return nil, &SyntaxError{Pos: name.pos, Msg: "defined() takes exactly one argument"}
+		}
+		if _, ok := call.args[0].(*refNode); !ok {
+			return nil, &SyntaxError{Pos: name.pos, Msg: "defined() takes a reference"}
+		}
+	case "version":
+		if len(call.args) != 1 {
+			return nil, &SyntaxError{Pos: name.pos, Msg: "version() takes exactly one argument"}
+		}
+	default:
+		return nil, &SyntaxError{Pos: name.pos, Msg: fmt.Sprintf("unknown function %q", call.name)}
+	}
+	return call, nil
+}
+
+func isKeyword(word string) bool {
+	switch word {
+	case "and", "or", "not", "in", "contains", "matches", "exits":
+		return true
+	}
+	return false
+}
+
+func describe(tok token) string {
+	switch tok.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return fmt.Sprintf("string %q", tok.text)
+	default:
+		return fmt.Sprintf("%q", tok.text)
+	}
+}
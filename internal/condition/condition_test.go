@@ -0,0 +1,220 @@
+package condition
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testEnv resolves references in nested maps and runs no commands; it
+// returns the exit codes listed in commands instead.
+type testEnv struct {
+	vars     map[string]interface{}
+	commands map[string]int
+}
+
+func (e testEnv) Lookup(path string) (interface{}, bool) {
+	var current interface{} = e.vars
+	for _, key := range strings.Split(path, ".") {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func (e testEnv) RunCommand(command string) (int, error) {
+	code, ok := e.commands[command]
+	if !ok {
+		return 0, errors.New("command not found")
+	}
+	return code, nil
+}
+
+var env = testEnv{
+	vars: map[string]interface{}{
+		"hostname": "db-01",
+		"APP_ENV":  "staging",
+		"rc":       2,
+		"stdout":   "package already installed",
+		"mariadb":  map[string]interface{}{"port": 3306, "version": "10.6"},
+		"facts": map[string]interface{}{
+			"os_family":            "debian",
+			"kernel":               "6.1.0-18-amd64",
+			"distribution_version": "9.10",
+			"groups":               []interface{}{"sudo", "adm"},
+		},
+	},
+	commands: map[string]int{"rpm -q mariadb-server": 1},
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		// Literals and precedence: not binds tighter than and, and than or
+		{"true", true},
+		{"false", false},
+		{"true or false and false", true},
+		{"(true or false) and false", false},
+		{"not false and false", false},
+		{"not (false and false)", true},
+		{"!false && true || false", true},
+		{"false || !true", false},
+
+		// Comparisons
+		{`facts.os_family == "debian"`, true},
+		{`facts.os_family != "debian"`, false},
+		{"mariadb.port == 3306", true},
+		{`mariadb.port == "3306"`, true},
+		{"mariadb.port > 1024", true},
+		{"mariadb.port <= 3305", false},
+		{`"b" > "a"`, true},
+		{"rc in [0, 2]", true},
+		{"rc not in [0, 1]", true},
+		{`APP_ENV in ["staging", "production"]`, true},
+		{`"sudo" in facts.groups`, true},
+		{`facts.groups contains "wheel"`, false},
+		{`stdout contains "already installed"`, true},
+		{`"already" in stdout`, true},
+
+		// Versions compare segment by segment
+		{`version(facts.distribution_version) >= "9.2"`, true},
+		{`version(facts.distribution_version) < "9.2"`, false},
+		{`version(mariadb.version) == "10.6"`, true},
+		{`version(mariadb.version) < "10.6.1"`, true},
+		{`version("1.2.3") < "1.10"`, true},
+
+		// Patterns
+		{`hostname matches "db-*"`, true},
+		{`hostname matches "web-*"`, false},
+		{`facts.kernel =~ "^6\\."`, true},
+		{`facts.kernel !~ "^6\\."`, false},
+
+		// defined() and commands
+		{"defined(mariadb.port)", true},
+		{"not defined(mariadb.socket)", true},
+		{"command 'rpm -q mariadb-server' exits 1", true},
+		{"command 'rpm -q mariadb-server' exits 0", false},
+		{`facts.kernel =~ "^6\\." && command 'rpm -q mariadb-server' exits 1`, true},
+
+		// A bare glob is shorthand for hostname matches
+		{"*", true},
+		{"db-*", true},
+		{"web-*", false},
+	}
+	for _, tt := range tests {
+		expr, err := Parse(tt.src)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.src, err)
+			continue
+		}
+		got, err := expr.Eval(env)
+		if err != nil {
+			t.Errorf("Eval(%q): %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Eval(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestEvalShortCircuit(t *testing.T) {
+	// The right side would fail on the undefined variable
+	for _, src := range []string{"false and undefined_var == 1", "true or undefined_var == 1"} {
+		expr, err := Parse(src)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", src, err)
+		}
+		if _, err := expr.Eval(env); err != nil {
+			t.Errorf("Eval(%q): %v", src, err)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+	}{
+		{"mariadb.socket == 1", `undefined variable "mariadb.socket"`},
+		{"command 'missing' exits 0", `command "missing"`},
+		{"facts.kernel =~ stdout", ""},
+		{"rc contains 1", "cannot search in value of type"},
+	}
+	for _, tt := range tests {
+		expr, err := Parse(tt.src)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.src, err)
+			continue
+		}
+		_, err = expr.Eval(env)
+		if tt.err == "" {
+			// A pattern from a variable is only compiled on evaluation
+			if err != nil {
+				t.Errorf("Eval(%q): %v", tt.src, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Eval(%q) error = %v, want %q", tt.src, err, tt.err)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		pos int
+		msg string
+	}{
+		{"a ==", 4, "expected a value, found end of expression"},
+		{"(a == 1", 7, `expected ")"`},
+		{"a == 1 b", 7, `unexpected "b"`},
+		{`a == "open`, 5, "unterminated string"},
+		{"a in [1, 2", 10, `expected ","`},
+		{`a =~ "("`, 5, "invalid regular expression"},
+		{`hostname matches "[a"`, 17, "invalid glob"},
+		{"command 'true' exits x", 21, "expected an exit code"},
+		{"defined(1)", 0, "defined() takes a reference"},
+		{"version(a, b) > 1", 0, "version() takes exactly one argument"},
+		{"length(a)", 0, `unknown function "length"`},
+		{"a == and", 5, `unexpected keyword "and"`},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.src)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Parse(%q) error = %v, want a SyntaxError", tt.src, err)
+			continue
+		}
+		if syntaxErr.Pos != tt.pos || !strings.Contains(syntaxErr.Msg, tt.msg) {
+			t.Errorf("Parse(%q) error = %d %q, want %d %q", tt.src, syntaxErr.Pos, syntaxErr.Msg, tt.pos, tt.msg)
+		}
+	}
+}
+
+func TestRefs(t *testing.T) {
+	expr, err := Parse(`mariadb.port == 1 and defined(mariadb.socket) or "x" in facts.groups or mariadb.port > 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"facts.groups", "mariadb.port", "mariadb.socket"}
+	if got := expr.Refs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Refs() = %v, want %v", got, want)
+	}
+
+	expr, err = Parse("web-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := expr.Refs(); !reflect.DeepEqual(got, []string{"hostname"}) {
+		t.Errorf("Refs() of a glob = %v, want [hostname]", got)
+	}
+}
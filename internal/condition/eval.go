@@ -0,0 +1,394 @@
+package condition
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+type node interface {
+	eval(env Env) (interface{}, error)
+	refs(seen map[string]bool)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(Env) (interface{}, error) { return n.value, nil }
+func (n *literalNode) refs(map[string]bool)          {}
+
+type refNode struct {
+	path string
+}
+
+func (n *refNode) eval(env Env) (interface{}, error) {
+	value, ok := env.Lookup(n.path)
+	if !ok {
+		return nil, fmt.Errorf("undefined variable %q", n.path)
+	}
+	return value, nil
+}
+
+func (n *refNode) refs(seen map[string]bool) { seen[n.path] = true }
+
+type listNode struct {
+	items []node
+}
+
+func (n *listNode) eval(env Env) (interface{}, error) {
+	values := make([]interface{}, 0, len(n.items))
+	for _, item := range n.items {
+		value, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func (n *listNode) refs(seen map[string]bool) {
+	for _, item := range n.items {
+		item.refs(seen)
+	}
+}
+
+type notNode struct {
+	operand node
+}
+
+func (n *notNode) eval(env Env) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(value), nil
+}
+
+func (n *notNode) refs(seen map[string]bool) { n.operand.refs(seen) }
+
+type logicalNode struct {
+	and         bool
+	left, right node
+}
+
+func (n *logicalNode) eval(env Env) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// Short-circuit so that e.g. defined(x) and x == 1 works
+	if truthy(left) != n.and {
+		return truthy(left), nil
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return truthy(right), nil
+}
+
+func (n *logicalNode) refs(seen map[string]bool) {
+	n.left.refs(seen)
+	n.right.refs(seen)
+}
+
+type commandNode struct {
+	command string
+	code    int
+}
+
+func (n *commandNode) eval(env Env) (interface{}, error) {
+	code, err := env.RunCommand(n.command)
+	if err != nil {
+		return nil, fmt.Errorf("command %q: %v", n.command, err)
+	}
+	return code == n.code, nil
+}
+
+func (n *commandNode) refs(map[string]bool) {}
+
+type callNode struct {
+	name string
+	args []node
+}
+
+func (n *callNode) eval(env Env) (interface{}, error) {
+	switch n.name {
+	case "defined":
+		_, ok := env.Lookup(n.args[0].(*refNode).path)
+		return ok, nil
+	case "version":
+		value, err := n.args[0].eval(env)
+		if err != nil {
+			return nil, err
+		}
+		return version(toString(value)), nil
+	}
+	return nil, fmt.Errorf("unknown function %q", n.name)
+}
+
+func (n *callNode) refs(seen map[string]bool) {
+	for _, arg := range n.args {
+		arg.refs(seen)
+	}
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+	re          *regexp.Regexp // precompiled for =~ and !~ with a literal pattern
+	glob        glob.Glob      // precompiled for matches with a literal pattern
+}
+
+func (n *compareNode) refs(seen map[string]bool) {
+	n.left.refs(seen)
+	n.right.refs(seen)
+}
+
+func (n *compareNode) eval(env Env) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<":
+		return compare(left, right) < 0, nil
+	case "<=":
+		return compare(left, right) <= 0, nil
+	case ">":
+		return compare(left, right) > 0, nil
+	case ">=":
+		return compare(left, right) >= 0, nil
+
+	case "=~", "!~":
+		re := n.re
+		if re == nil {
+			if re, err = regexp.Compile(toString(right)); err != nil {
+				return nil, fmt.Errorf("invalid regular expression: %v", err)
+			}
+		}
+		return re.MatchString(toString(left)) == (n.op == "=~"), nil
+
+	case "matches":
+		g := n.glob
+		if g == nil {
+			if g, err = glob.Compile(toString(right)); err != nil {
+				return nil, fmt.Errorf("invalid glob %q: %v", toString(right), err)
+			}
+		}
+		return g.Match(toString(left)), nil
+
+	case "in", "not in":
+		found, err := contains(right, left)
+		if err != nil {
+			return nil, err
+		}
+		return found == (n.op == "in"), nil
+
+	case "contains":
+		return contains(left, right)
+	}
+
+	return nil, fmt.Errorf("unknown operator %q", n.op)
+}
+
+// version marks a value for version comparison.
+type version string
+
+// truthy converts a value to a boolean. Empty values, zero, false and the
+// strings "false" and "0" are false.
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != "" && v != "false" && v != "0"
+	case version:
+		return v != ""
+	}
+	if n, ok := toNumber(value); ok {
+		return n != 0
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Map:
+		return rv.Len() > 0
+	}
+	return true
+}
+
+// equal compares two values. Numbers compare numerically, also when one side
+// is a numeric string, everything else by its string form.
+func equal(a, b interface{}) bool {
+	if _, ok := a.(version); ok {
+		return compare(a, b) == 0
+	}
+	if _, ok := b.(version); ok {
+		return compare(a, b) == 0
+	}
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if isNumber(a) || isNumber(b) {
+		x, okA := toNumber(a)
+		y, okB := toNumber(b)
+		if okA && okB {
+			return x == y
+		}
+	}
+	if isScalar(a) && isScalar(b) {
+		return toString(a) == toString(b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// compare orders two values: as versions if either side is a version, as
+// numbers if both are numeric, and as strings otherwise.
+func compare(a, b interface{}) int {
+	_, versionA := a.(version)
+	_, versionB := b.(version)
+	if versionA || versionB {
+		return compareVersions(toString(a), toString(b))
+	}
+	if x, ok := toNumber(a); ok {
+		if y, ok := toNumber(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	return strings.Compare(toString(a), toString(b))
+}
+
+// compareVersions compares dotted version strings segment by segment.
+// Numeric segments compare numerically, others as strings, and a missing
+// segment sorts before a present one (9 < 9.1).
+func compareVersions(a, b string) int {
+	split := func(s string) []string {
+		return strings.FieldsFunc(s, func(r rune) bool {
+			return r == '.' || r == '-' || r == '_' || r == '+' || r == ':' || r == '~'
+		})
+	}
+	as, bs := split(a), split(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		if i >= len(as) {
+			return -1
+		}
+		if i >= len(bs) {
+			return 1
+		}
+		x, errA := strconv.Atoi(as[i])
+		y, errB := strconv.Atoi(bs[i])
+		if errA == nil && errB == nil {
+			if x != y {
+				if x < y {
+					return -1
+				}
+				return 1
+			}
+			continue
+		}
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// contains reports whether container holds item. Lists and maps are
+// searched for an equal element or key, strings for a substring.
+func contains(container, item interface{}) (bool, error) {
+	switch c := container.(type) {
+	case string:
+		return strings.Contains(c, toString(item)), nil
+	case nil:
+		return false, nil
+	}
+
+	rv := reflect.ValueOf(container)
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if equal(rv.Index(i).Interface(), item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case reflect.Map:
+		for _, key := range rv.MapKeys() {
+			if equal(key.Interface(), item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("cannot search in value of type %T", container)
+}
+
+func isNumber(value interface{}) bool {
+	switch value.(type) {
+	case int, int64, uint64, float64:
+		return true
+	}
+	return false
+}
+
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case string, bool, version, int, int64, uint64, float64:
+		return true
+	}
+	return false
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case version:
+		return string(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,304 @@
+// Package diff produces unified diffs of text files, as shown for the
+// changes made by file modules.
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// context is the number of unchanged lines shown around each change.
+const context = 3
+
+// maxLines limits the size of files that are diffed. Memory is linear in
+// the number of lines, but the time grows with the number of lines times
+// the number of differences.
+const maxLines = 20000
+
+// Unified returns the unified diff between old and new, labelled with
+// oldName and newName. It returns "" if both are equal. Binary content is
+// only reported as differing.
+func Unified(oldName, newName, old, new string) string {
+	if old == new {
+		return ""
+	}
+	if isBinary(old) || isBinary(new) {
+		return fmt.Sprintf("Binary files %s and %s differ\n", oldName, newName)
+	}
+
+	a, b := splitLines(old), splitLines(new)
+	if len(a)+len(b) > maxLines {
+		return fmt.Sprintf("Files %s and %s differ (too large to diff)\n", oldName, newName)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+	for _, h := range hunks(edits(a, b)) {
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(h.aStart, h.aLines), hunkRange(h.bStart, h.bLines))
+		for _, l := range h.lines {
+			buf.WriteString(l)
+			if !strings.HasSuffix(l, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	return buf.String()
+}
+
+func isBinary(s string) bool {
+	return strings.IndexByte(s, 0) >= 0 || !utf8.ValidString(s)
+}
+
+// splitLines splits s into lines that keep their line endings.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// op is one step of an edit script.
+type op struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// edits computes an edit script from a to b. It uses the linear space
+// variant of Myers' algorithm: the middle snake of the shortest edit path
+// splits the problem in two halves that are diffed on their own.
+func edits(a, b []string) []op {
+	var script []op
+	diffRange(&script, a, b)
+	return script
+}
+
+// diffRange appends the edit script from a to b to script.
+func diffRange(script *[]op, a, b []string) {
+	// Lines shared at the start and the end are unchanged
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		*script = append(*script, op{' ', a[prefix]})
+		prefix++
+	}
+	a, b = a[prefix:], b[prefix:]
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	switch {
+	case len(a) == 0:
+		for _, line := range b {
+			*script = append(*script, op{'+', line})
+		}
+	case len(b) == 0:
+		for _, line := range a {
+			*script = append(*script, op{'-', line})
+		}
+	default:
+		if x, y, ok := middleSnake(a, b); ok {
+			diffRange(script, a[:x], b[:y])
+			diffRange(script, a[x:], b[y:])
+			break
+		}
+		for _, line := range a {
+			*script = append(*script, op{'-', line})
+		}
+		for _, line := range b {
+			*script = append(*script, op{'+', line})
+		}
+	}
+
+	for _, line := range common {
+		*script = append(*script, op{' ', line})
+	}
+}
+
+// middleSnake returns the point where the forward and the reverse search
+// for the shortest edit path from a to b meet. a and b are not empty and
+// differ in their first and last lines. ok is false if the paths do not meet
+// before the end, which means that no line of a is kept. Only two frontiers
+// of O(len(a)+len(b)) are kept.
+func middleSnake(a, b []string) (int, int, bool) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	forward := make([]int, 2*maxD+2)
+	reverse := make([]int, 2*maxD+2)
+	for i := range forward {
+		forward[i], reverse[i] = -1, -1
+	}
+	forward[offset+1], reverse[offset+1] = 0, 0
+
+	delta := n - m
+	// With an odd delta the paths meet on a forward step, else on a
+	// reverse one
+	odd := delta%2 != 0
+	// Diagonals that left the edit graph are not searched again
+	fStart, fEnd, rStart, rEnd := 0, 0, 0, 0
+
+	for d := 0; d < maxD; d++ {
+		for k := -d + fStart; k <= d-fEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && forward[i-1] < forward[i+1]) {
+				x = forward[i+1]
+			} else {
+				x = forward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[i] = x
+			switch {
+			case x > n:
+				fEnd += 2
+			case y > m:
+				fStart += 2
+			case odd:
+				j := offset + delta - k
+				if j >= 0 && j < len(reverse) && reverse[j] != -1 && x >= n-reverse[j] {
+					return x, y, true
+				}
+			}
+		}
+
+		for k := -d + rStart; k <= d-rEnd; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && reverse[i-1] < reverse[i+1]) {
+				x = reverse[i+1]
+			} else {
+				x = reverse[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			reverse[i] = x
+			switch {
+			case x > n:
+				rEnd += 2
+			case y > m:
+				rStart += 2
+			case !odd:
+				j := offset + delta - k
+				if j >= 0 && j < len(forward) && forward[j] != -1 {
+					fx := forward[j]
+					if fx >= n-x {
+						return fx, fx - (j - offset), true
+					}
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+type hunk struct {
+	aStart, aLines int
+	bStart, bLines int
+	lines          []string
+}
+
+// hunks groups an edit script into hunks with context lines around every
+// change.
+func hunks(script []op) []hunk {
+	var (
+		result []hunk
+		cur    *hunk
+		aLine  int // lines of a consumed so far
+		bLine  int
+		equal  int // unchanged lines at the end of the current hunk
+	)
+	for i, e := range script {
+		if e.kind == ' ' {
+			if cur != nil {
+				if equal < context || nextChange(script, i) <= context {
+					cur.lines = append(cur.lines, " "+e.line)
+					cur.aLines++
+					cur.bLines++
+					equal++
+				} else {
+					trimContext(cur, equal)
+					result = append(result, *cur)
+					cur = nil
+				}
+			}
+			aLine++
+			bLine++
+			continue
+		}
+
+		if cur == nil {
+			// Start a new hunk with up to context lines before the change
+			start := i
+			for start > 0 && i-start < context && script[start-1].kind == ' ' {
+				start--
+			}
+			cur = &hunk{aStart: aLine - (i - start), bStart: bLine - (i - start)}
+			for _, c := range script[start:i] {
+				cur.lines = append(cur.lines, " "+c.line)
+				cur.aLines++
+				cur.bLines++
+			}
+		}
+		equal = 0
+		cur.lines = append(cur.lines, string(e.kind)+e.line)
+		if e.kind == '-' {
+			cur.aLines++
+			aLine++
+		} else {
+			cur.bLines++
+			bLine++
+		}
+	}
+	if cur != nil {
+		trimContext(cur, equal)
+		result = append(result, *cur)
+	}
+	return result
+}
+
+// nextChange returns the distance from i to the next change in script, or
+// a large number if there is none.
+func nextChange(script []op, i int) int {
+	for j := i; j < len(script); j++ {
+		if script[j].kind != ' ' {
+			return j - i
+		}
+	}
+	return len(script)
+}
+
+// trimContext drops trailing unchanged lines beyond the context size.
+func trimContext(h *hunk, equal int) {
+	if extra := equal - context; extra > 0 {
+		h.lines = h.lines[:len(h.lines)-extra]
+		h.aLines -= extra
+		h.bLines -= extra
+	}
+}
+
+// hunkRange formats the line range of a hunk, which is 1-based except for
+// empty ranges.
+func hunkRange(start, lines int) string {
+	if lines == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if lines == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, lines)
+}
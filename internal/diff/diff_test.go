@@ -0,0 +1,126 @@
+package diff
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestUnified(t *testing.T) {
+	old := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm\n"
+	new := "a\nb\nc\nD\ne\nf\ng\nh\ni\nj\nk\nl\nm\nn"
+	want := `--- old
++++ new
+@@ -1,7 +1,7 @@
+ a
+ b
+ c
+-d
++D
+ e
+ f
+ g
+@@ -11,3 +11,4 @@
+ k
+ l
+ m
++n
+\ No newline at end of file
+`
+	if got := Unified("old", "new", old, new); got != want {
+		t.Errorf("Unified =\n%s\nwant\n%s", got, want)
+	}
+	if got := Unified("old", "new", old, old); got != "" {
+		t.Errorf("Unified of equal content = %q, want \"\"", got)
+	}
+	if got := Unified("old", "new", "a\x00", "b"); got != "Binary files old and new differ\n" {
+		t.Errorf("Unified of binary content = %q", got)
+	}
+}
+
+// checkScript verifies that script turns a into b and returns the number of
+// inserted and deleted lines.
+func checkScript(t *testing.T, a, b []string, script []op) int {
+	t.Helper()
+	var gotA, gotB []string
+	changes := 0
+	for _, e := range script {
+		switch e.kind {
+		case ' ':
+			gotA = append(gotA, e.line)
+			gotB = append(gotB, e.line)
+		case '-':
+			gotA = append(gotA, e.line)
+			changes++
+		case '+':
+			gotB = append(gotB, e.line)
+			changes++
+		}
+	}
+	if strings.Join(gotA, "") != strings.Join(a, "") || strings.Join(gotB, "") != strings.Join(b, "") {
+		t.Fatalf("script does not turn %q into %q: %v", a, b, script)
+	}
+	return changes
+}
+
+// lcs returns the length of the longest common subsequence of a and b.
+func lcs(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for i := range a {
+		for j := range b {
+			switch {
+			case a[i] == b[j]:
+				cur[j+1] = prev[j] + 1
+			case prev[j+1] > cur[j]:
+				cur[j+1] = prev[j+1]
+			default:
+				cur[j+1] = cur[j]
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func TestEditsShortest(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, r.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a'+r.Intn(4))) + "\n"
+		}
+		return lines
+	}
+	for i := 0; i < 2000; i++ {
+		a, b := randomLines(), randomLines()
+		changes := checkScript(t, a, b, edits(a, b))
+		if want := len(a) + len(b) - 2*lcs(a, b); changes != want {
+			t.Fatalf("edits(%q, %q) has %d changes, want %d", a, b, changes, want)
+		}
+	}
+}
+
+func TestEditsLargeRewrite(t *testing.T) {
+	// Every line differs, the worst case for the number of differences
+	n := maxLines / 2
+	a, b := make([]string, n), make([]string, n)
+	for i := range a {
+		a[i] = fmt.Sprintf("old line %d\n", i)
+		b[i] = fmt.Sprintf("new line %d\n", i)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	script := edits(a, b)
+	runtime.ReadMemStats(&after)
+
+	if changes := checkScript(t, a, b, script); changes != 2*n {
+		t.Errorf("changes = %d, want %d", changes, 2*n)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 64<<20 {
+		t.Errorf("diffing %d fully changed lines allocated %d MB", 2*n, allocated>>20)
+	}
+}
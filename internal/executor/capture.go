@@ -0,0 +1,102 @@
+package executor
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// DefaultOutputLimit is the number of bytes of stdout and of stderr kept of
+// a command unless SetOutputLimit says otherwise.
+const DefaultOutputLimit = 64 << 10
+
+// capture keeps the first and the last bytes written to it, half of the
+// limit each, and counts the bytes in between that it drops. A limit of zero
+// or less keeps everything.
+type capture struct {
+	limit int
+	head  []byte
+	tail  []byte
+	total int64
+}
+
+func (c *capture) Write(p []byte) (int, error) {
+	n := len(p)
+	c.total += int64(n)
+	if c.limit <= 0 {
+		c.head = append(c.head, p...)
+		return n, nil
+	}
+
+	headLimit := c.limit - c.limit/2
+	if room := headLimit - len(c.head); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		c.head = append(c.head, p[:room]...)
+		p = p[room:]
+	}
+
+	tailLimit := c.limit / 2
+	if len(p) >= tailLimit {
+		c.tail = append(c.tail[:0], p[len(p)-tailLimit:]...)
+		return n, nil
+	}
+	c.tail = append(c.tail, p...)
+	// Only move the tail to the front once it has grown to twice its size
+	if len(c.tail) > 2*tailLimit {
+		c.tail = append(c.tail[:0], c.tail[len(c.tail)-tailLimit:]...)
+	}
+	return n, nil
+}
+
+// truncated reports whether bytes were dropped.
+func (c *capture) truncated() bool {
+	return c.limit > 0 && c.total > int64(c.limit)
+}
+
+// String returns the kept output with a marker in place of the dropped
+// bytes. Characters cut in half at the edges of the marker are dropped as
+// well and counted in the marker; binary output is kept as it is.
+func (c *capture) String() string {
+	if !c.truncated() {
+		return string(c.head) + string(c.tail)
+	}
+
+	tail := c.tail
+	if len(tail) > c.limit/2 {
+		tail = tail[len(tail)-c.limit/2:]
+	}
+	head := trimHead(c.head)
+	tail = trimTail(tail)
+
+	dropped := c.total - int64(len(head)) - int64(len(tail))
+	return fmt.Sprintf("%s\n[... %d bytes truncated ...]\n%s", head, dropped, tail)
+}
+
+// trimHead drops the start of a character cut in half at the end of head,
+// but only if the rest is valid UTF-8, so that binary output is kept whole.
+func trimHead(head []byte) []byte {
+	for n := 1; n < utf8.UTFMax && n <= len(head); n++ {
+		cut := head[len(head)-n:]
+		if utf8.RuneStart(cut[0]) {
+			if !utf8.FullRune(cut) && utf8.Valid(head[:len(head)-n]) {
+				return head[:len(head)-n]
+			}
+			break
+		}
+	}
+	return head
+}
+
+// trimTail drops the rest of a character cut in half at the start of tail,
+// but only if the rest is valid UTF-8.
+func trimTail(tail []byte) []byte {
+	n := 0
+	for n < utf8.UTFMax-1 && n < len(tail) && !utf8.RuneStart(tail[n]) {
+		n++
+	}
+	if n > 0 && utf8.Valid(tail[n:]) {
+		return tail[n:]
+	}
+	return tail
+}
@@ -0,0 +1,124 @@
+package executor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCapture(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		writes []string
+		want   string
+	}{
+		{"empty", 10, nil, ""},
+		{"within limit", 10, []string{"hello", "world"}, "helloworld"},
+		{"no limit", 0, []string{strings.Repeat("x", 100)}, strings.Repeat("x", 100)},
+		{"negative limit", -1, []string{"abc", "def"}, "abcdef"},
+		{"one write", 10, []string{"0123456789abcdefghij"}, "01234\n[... 10 bytes truncated ...]\nfghij"},
+		{"small writes", 10, strings.Split("0123456789abcdefghij", ""), "01234\n[... 10 bytes truncated ...]\nfghij"},
+		{"odd limit", 5, []string{"abcdefgh"}, "abc\n[... 3 bytes truncated ...]\ngh"},
+		{"one byte over", 4, []string{"ab", "cde"}, "ab\n[... 1 bytes truncated ...]\nde"},
+		{"long tail write", 6, []string{"ab", "cdefghijkl", "m"}, "abc\n[... 7 bytes truncated ...]\nklm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &capture{limit: tt.limit}
+			for _, w := range tt.writes {
+				if n, err := c.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if got := c.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+			if got, want := c.truncated(), strings.Contains(tt.want, "truncated"); got != want {
+				t.Errorf("truncated() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestCaptureBoundedMemory(t *testing.T) {
+	c := &capture{limit: 64}
+	line := []byte("some output line\n")
+	for i := 0; i < 10000; i++ {
+		c.Write(line)
+	}
+	if len(c.head) > 32 || len(c.tail) > 64 {
+		t.Errorf("capture keeps %d+%d bytes for a limit of 64", len(c.head), len(c.tail))
+	}
+	if want := int64(10000 * len(line)); c.total != want {
+		t.Errorf("total = %d, want %d", c.total, want)
+	}
+	if got := c.String(); !strings.HasSuffix(got, "line\n") {
+		t.Errorf("String() does not end with the last output: %q", got)
+	}
+}
+
+func TestCaptureUTF8(t *testing.T) {
+	// Each ä is two bytes, so both edges of the marker cut a character
+	c := &capture{limit: 8}
+	c.Write([]byte("aääääääääa"))
+	got := c.String()
+	if !utf8.ValidString(got) {
+		t.Fatalf("String() is not valid UTF-8: %q", got)
+	}
+	if want := "aä\n[... 12 bytes truncated ...]\näa"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestCaptureBinary(t *testing.T) {
+	// Bytes that are not UTF-8 are kept and the marker counts exactly what
+	// was dropped
+	data := []byte{0xff, 0xfe, 0xc3, 0x00, 0x01, 0x02, 0x03, 0x80, 0x81, 0xe2}
+	c := &capture{limit: 6}
+	c.Write(data)
+	want := "\xff\xfe\xc3\n[... 4 bytes truncated ...]\n\x80\x81\xe2"
+	if got := c.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestExecuteTruncatesToSpool(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	e := NewExecutor()
+	e.SetOutputLimit(10)
+	e.SetSpoolDir(t.TempDir())
+
+	output, err := e.ExecuteWithEnv(context.Background(), "printf 0123456789abcdefghij", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "01234\n[... 10 bytes truncated ...]\nfghij"; output.Stdout != want {
+		t.Errorf("stdout = %q, want %q", output.Stdout, want)
+	}
+	if output.Spool == "" {
+		t.Fatal("truncated output was not spooled")
+	}
+	data, err := os.ReadFile(filepath.Join(e.spoolDir, output.Spool))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "0123456789abcdefghij" {
+		t.Errorf("spool = %q, want the full output", data)
+	}
+
+	// Output within the limit leaves no spool file behind
+	output, err = e.ExecuteWithEnv(context.Background(), "echo short", nil)
+	if err != nil || output.Spool != "" {
+		t.Errorf("short output: spool = %q, err = %v", output.Spool, err)
+	}
+	if entries, _ := os.ReadDir(e.spoolDir); len(entries) != 1 {
+		t.Errorf("spool directory holds %d files, want 1", len(entries))
+	}
+}
@@ -2,15 +2,49 @@ package executor
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 )
 
+// defaultPath makes sure the usual system binaries can be found even when
+// the client runs with a minimal environment.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// terminateGracePeriod is how long a process group may take to exit after it
+// was asked to terminate before it is killed.
+const terminateGracePeriod = 10 * time.Second
+
+// waitDelay is how long the output of a command is still read after it
+// exited. A background child that keeps stdout or stderr open does not hold
+// up the task beyond that.
+const waitDelay = time.Second
+
+// spoolRetention is how long spool files are kept.
+const spoolRetention = 7 * 24 * time.Hour
+
 type Executor struct {
-	shell string
+	shell       string
+	outputLimit int
+	spoolDir    string
+}
+
+// Output is what a program run by RunArgs produced.
+type Output struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// Spool is the name of the file in the spool directory that holds the
+	// full output of a command whose output was truncated
+	Spool string
 }
 
 func NewExecutor() *Executor {
@@ -20,15 +54,99 @@ func NewExecutor() *Executor {
 	}
 	
 	return &Executor{
-		shell: shell,
+		shell:       shell,
+		outputLimit: DefaultOutputLimit,
 	}
 }
 
-func (e *Executor) Execute(command string) (string, error) {
-	return e.ExecuteWithEnv(command, nil)
+// SetOutputLimit sets how many bytes of stdout and of stderr ExecuteWithEnv
+// keeps of a command. The first and the last half are kept and the bytes in
+// between replaced by a marker. Zero or less keeps everything.
+func (e *Executor) SetOutputLimit(limit int) {
+	e.outputLimit = limit
 }
 
-func (e *Executor) ExecuteWithEnv(command string, env map[string]string) (string, error) {
+// SetSpoolDir makes ExecuteWithEnv write the full output of commands to a
+// file in dir, which is kept if the output had to be truncated. An empty dir
+// turns spooling off.
+func (e *Executor) SetSpoolDir(dir string) {
+	e.spoolDir = dir
+}
+
+func (e *Executor) Execute(ctx context.Context, command string) (Output, error) {
+	return e.ExecuteWithEnv(ctx, command, nil)
+}
+
+// ExitCode runs a command and returns its exit code, discarding its output.
+// It is used for checks such as condition commands.
+func (e *Executor) ExitCode(ctx context.Context, command string) (int, error) {
+	return e.ExitCodeWithEnv(ctx, command, nil)
+}
+
+// ExitCodeWithEnv is ExitCode with additional environment variables.
+func (e *Executor) ExitCodeWithEnv(ctx context.Context, command string, env map[string]string) (int, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command(e.shell, "/C", command)
+	} else {
+		cmd = exec.Command(e.shell, "-c", command)
+	}
+	cmd.Env = os.Environ()
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	cmd.Env = append(cmd.Env, "PATH="+defaultPath)
+
+	err := run(ctx, cmd)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// RunArgs runs a program directly, without a shell, so its arguments need no
+// quoting. A non-zero exit code is reported in the output and is not an
+// error; err is only set if the program could not be run at all.
+func (e *Executor) RunArgs(ctx context.Context, env map[string]string, name string, args ...string) (Output, error) {
+	return e.RunInput(ctx, env, nil, name, args...)
+}
+
+// RunInput is RunArgs with input passed to the program on stdin.
+func (e *Executor) RunInput(ctx context.Context, env map[string]string, input []byte, name string, args ...string) (Output, error) {
+	cmd := exec.Command(name, args...)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	cmd.Env = append(os.Environ(), "PATH="+defaultPath)
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := run(ctx, cmd)
+	output := Output{
+		Stdout: strings.TrimSpace(stdout.String()),
+		Stderr: strings.TrimSpace(stderr.String()),
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		output.ExitCode = exitErr.ExitCode()
+		return output, nil
+	}
+	return output, err
+}
+
+// ExecuteWithEnv runs command in the shell exactly as given. Use ApplyPolicy
+// first to make package managers run non-interactively. The output is
+// returned even if the command failed; a non-zero exit code is an error.
+// ExitCode is -1 if the command was stopped by a signal or could not be
+// run. Stdout and stderr are truncated to the output limit.
+func (e *Executor) ExecuteWithEnv(ctx context.Context, command string, env map[string]string) (Output, error) {
 	var cmd *exec.Cmd
 	
 	if runtime.GOOS == "windows" {
@@ -43,77 +161,121 @@ func (e *Executor) ExecuteWithEnv(command string, env map[string]string) (string
 	}
 
 	// Ensure full PATH is available
-	env["PATH"] = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
-
-	// Handle different package managers
-	switch {
-	case strings.Contains(command, "apt-get") || strings.Contains(command, "apt"):
-		// Debian/Ubuntu package management
-		env["DEBIAN_FRONTEND"] = "noninteractive"
-		env["DEBIAN_PRIORITY"] = "critical"
-		env["TERM"] = "linux"
-		env["DEBIAN_FRONTEND"] = "noninteractive"
-		env["APT_LISTCHANGES_FRONTEND"] = "none"
-		env["UCF_FORCE_CONFFOLD"] = "true"
-
-		// Add -y flag to apt-get if not present
-		if strings.Contains(command, "apt-get") && !strings.Contains(command, " -y ") && !strings.HasSuffix(command, " -y") {
-			command = strings.Replace(command, "apt-get ", "apt-get -y --allow-downgrades --allow-remove-essential --allow-change-held-packages ", 1)
-		}
+	env["PATH"] = defaultPath
 
-		// Add -y flag to apt if not present
-		if strings.Contains(command, "apt ") && !strings.Contains(command, " -y ") && !strings.HasSuffix(command, " -y") {
-			command = strings.Replace(command, "apt ", "apt -y --allow-downgrades --allow-remove-essential --allow-change-held-packages ", 1)
-		}
+	// Set up full environment
+	cmd.Env = os.Environ() // Start with current environment
+	for k, v := range env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
 
-		// For install commands, add additional options
-		if strings.Contains(command, "install") {
-			if !strings.Contains(command, "-o Dpkg::Options") {
-				command = command + " -o Dpkg::Options::=\"--force-confdef\" -o Dpkg::Options::=\"--force-confold\" -o Dpkg::Options::=\"--force-confnew\""
-			}
-		}
+	stdout := &capture{limit: e.outputLimit}
+	stderr := &capture{limit: e.outputLimit}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
-		// Try to fix package system if installing
-		if strings.Contains(command, "install") {
-			command = fmt.Sprintf("dpkg --configure -a || true; apt-get update || true; %s", command)
-		}
+	spool := e.createSpool()
+	if spool != nil {
+		cmd.Stdout = io.MultiWriter(stdout, spool)
+		cmd.Stderr = io.MultiWriter(stderr, spool)
+	}
 
-	case strings.Contains(command, "yum"):
-		// RHEL/CentOS package management (older versions)
-		if !strings.Contains(command, " -y ") && !strings.HasSuffix(command, " -y") {
-			if strings.Contains(command, "yum ") {
-				command = strings.Replace(command, "yum ", "yum -y ", 1)
-			}
+	err := run(ctx, cmd)
+	output := Output{
+		Stdout: strings.TrimSpace(stdout.String()),
+		Stderr: strings.TrimSpace(stderr.String()),
+	}
+	if spool != nil {
+		spool.Close()
+		if stdout.truncated() || stderr.truncated() {
+			output.Spool = filepath.Base(spool.Name())
+		} else {
+			os.Remove(spool.Name())
+		}
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		output.ExitCode = exitErr.ExitCode()
+		if output.ExitCode == -1 {
+			return output, fmt.Errorf("command was stopped: %v", err)
 		}
+		return output, fmt.Errorf("command exited with code %d", output.ExitCode)
+	}
+	if err != nil {
+		output.ExitCode = -1
+		return output, fmt.Errorf("command failed: %v", err)
+	}
+
+	return output, nil
+}
+
+// createSpool creates a file for the full output of a command in the spool
+// directory and removes spool files older than spoolRetention. Spooling is
+// best effort: nil is returned if the file cannot be created.
+func (e *Executor) createSpool() *os.File {
+	if e.spoolDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(e.spoolDir, 0700); err != nil {
+		log.Printf("Error creating spool directory: %v", err)
+		return nil
+	}
 
-	case strings.Contains(command, "dnf"):
-		// RHEL/CentOS package management (newer versions)
-		if !strings.Contains(command, " -y ") && !strings.HasSuffix(command, " -y") {
-			if strings.Contains(command, "dnf ") {
-				command = strings.Replace(command, "dnf ", "dnf -y ", 1)
+	entries, err := os.ReadDir(e.spoolDir)
+	if err == nil {
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err == nil && info.Mode().IsRegular() && time.Since(info.ModTime()) > spoolRetention {
+				os.Remove(filepath.Join(e.spoolDir, entry.Name()))
 			}
 		}
 	}
 
-	// Set up full environment
-	cmd.Env = os.Environ() // Start with current environment
-	for k, v := range env {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	f, err := os.CreateTemp(e.spoolDir, time.Now().Format("20060102-150405-")+"*.log")
+	if err != nil {
+		log.Printf("Error creating spool file: %v", err)
+		return nil
 	}
+	return f
+}
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// run runs cmd in a process group of its own until it exits or ctx is done.
+// The whole group is then asked to terminate and killed if it has not exited
+// after terminateGracePeriod, so that no child of a shell keeps running.
+// The error is ctx.Err() if the command was stopped.
+func run(ctx context.Context, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+	cmd.WaitDelay = waitDelay
+	if err := cmd.Start(); err != nil {
+		return err
+	}
 
-	err := cmd.Run()
-	output := strings.TrimSpace(stdout.String())
-	if err != nil {
-		errStr := strings.TrimSpace(stderr.String())
-		if errStr != "" {
-			output = errStr
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if errors.Is(err, exec.ErrWaitDelay) {
+			// The command succeeded, only its output was cut off
+			return nil
 		}
-		return output, fmt.Errorf("command failed: %v\nOutput: %s", err, output)
+		return err
+	case <-ctx.Done():
 	}
 
-	return output, nil
+	terminateProcessGroup(cmd)
+	select {
+	case <-done:
+		return ctx.Err()
+	case <-time.After(terminateGracePeriod):
+	}
+	killProcessGroup(cmd)
+	// A process that left the group could still hold stdout open, so do
+	// not wait for it forever
+	select {
+	case <-done:
+	case <-time.After(terminateGracePeriod):
+	}
+	return ctx.Err()
 }
@@ -0,0 +1,34 @@
+package executor
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestExecuteBackgroundChild(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a POSIX shell")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// The sleep keeps stdout open after the shell exited
+	start := time.Now()
+	output, err := NewExecutor().ExecuteWithEnv(ctx, "sleep 30 & echo started", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output.Stdout != "started" || output.ExitCode != 0 {
+		t.Errorf("stdout = %q, exit code = %d", output.Stdout, output.ExitCode)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("command returned after %s, it waited for the background child", elapsed)
+	}
+
+	output, err = NewExecutor().ExecuteWithEnv(ctx, "sleep 30 & exit 3", nil)
+	if err == nil || output.ExitCode != 3 {
+		t.Errorf("exit code = %d, err = %v, want 3", output.ExitCode, err)
+	}
+}
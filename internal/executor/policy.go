@@ -0,0 +1,247 @@
+package executor
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Command policies select how a command: string may be rewritten before it
+// runs. Nothing is rewritten unless a policy asks for it.
+const (
+	// PolicyNone runs commands exactly as written
+	PolicyNone = "none"
+	// PolicyNoninteractive makes package manager invocations run without
+	// prompting:
+	//   apt, apt-get  -y is added and DEBIAN_FRONTEND=noninteractive,
+	//                 DEBIAN_PRIORITY=critical, APT_LISTCHANGES_FRONTEND=none
+	//                 and UCF_FORCE_CONFFOLD=true are set
+	//   dnf, yum      -y is added
+	//   zypper        --non-interactive is added
+	// Flags are only added if the command has no equivalent flag already and
+	// environment variables set by the task take precedence.
+	PolicyNoninteractive = "noninteractive"
+)
+
+// ValidatePolicy checks that policy names a known command policy. An empty
+// policy is the same as none.
+func ValidatePolicy(policy string) error {
+	switch policy {
+	case "", PolicyNone, PolicyNoninteractive:
+		return nil
+	}
+	return fmt.Errorf("unknown policy %q, expected %s or %s", policy, PolicyNone, PolicyNoninteractive)
+}
+
+// noninteractive describes what PolicyNoninteractive does for one program.
+type noninteractive struct {
+	flag    string
+	present []string // flags that already have the same effect
+	env     map[string]string
+}
+
+var aptNoninteractive = noninteractive{
+	flag:    "-y",
+	present: []string{"-y", "--yes", "--assume-yes"},
+	env: map[string]string{
+		"DEBIAN_FRONTEND":          "noninteractive",
+		"DEBIAN_PRIORITY":          "critical",
+		"APT_LISTCHANGES_FRONTEND": "none",
+		"UCF_FORCE_CONFFOLD":       "true",
+	},
+}
+
+var noninteractivePrograms = map[string]noninteractive{
+	"apt":     aptNoninteractive,
+	"apt-get": aptNoninteractive,
+	"dnf":     {flag: "-y", present: []string{"-y", "--assumeyes"}},
+	"yum":     {flag: "-y", present: []string{"-y", "--assumeyes"}},
+	"zypper":  {flag: "--non-interactive", present: []string{"-n", "--non-interactive"}},
+}
+
+// ApplyPolicy returns the command and environment to run under policy. Only
+// programs actually invoked by the command are considered, so "echo captain"
+// or a path containing apt is never touched. Every change is described in
+// changes so that it can be logged; env is not modified.
+func ApplyPolicy(policy, command string, env map[string]string) (string, map[string]string, []string) {
+	if policy != PolicyNoninteractive {
+		return command, env, nil
+	}
+
+	type insertion struct {
+		at   int
+		text string
+	}
+	var (
+		insertions []insertion
+		changes    []string
+		setEnv     = make(map[string]string)
+	)
+	for _, words := range simpleCommands(command) {
+		program, rest := programOf(words)
+		if program == nil {
+			continue
+		}
+		name := filepath.Base(program.text)
+		rule, ok := noninteractivePrograms[name]
+		if !ok {
+			continue
+		}
+		if !hasAnyWord(rest, rule.present) {
+			insertions = append(insertions, insertion{at: program.end, text: " " + rule.flag})
+			changes = append(changes, fmt.Sprintf("added %s to %s", rule.flag, name))
+		}
+		for k, v := range rule.env {
+			setEnv[k] = v
+		}
+	}
+
+	for i := len(insertions) - 1; i >= 0; i-- {
+		ins := insertions[i]
+		command = command[:ins.at] + ins.text + command[ins.at:]
+	}
+
+	if len(setEnv) > 0 {
+		merged := make(map[string]string, len(env)+len(setEnv))
+		var keys []string
+		for k, v := range setEnv {
+			if _, ok := env[k]; ok {
+				continue
+			}
+			merged[k] = v
+			keys = append(keys, k)
+		}
+		for k, v := range env {
+			merged[k] = v
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			changes = append(changes, fmt.Sprintf("set %s=%s", k, setEnv[k]))
+		}
+		env = merged
+	}
+
+	return command, env, changes
+}
+
+// word is a shell word and its position in the command. text is the word
+// with quotes removed.
+type word struct {
+	text       string
+	start, end int
+}
+
+// simpleCommands splits a shell command line into the words of each simple
+// command. Quoting and escaping are honoured; anything more involved, such
+// as here-documents or substitutions, is treated as plain words, which at
+// worst means a program is not recognized.
+func simpleCommands(command string) [][]word {
+	var (
+		commands [][]word
+		current  []word
+		text     strings.Builder
+		start    = -1
+		quote    byte
+	)
+	endWord := func(end int) {
+		if start >= 0 {
+			current = append(current, word{text: text.String(), start: start, end: end})
+			text.Reset()
+			start = -1
+		}
+	}
+	endCommand := func() {
+		if len(current) > 0 {
+			commands = append(commands, current)
+			current = nil
+		}
+	}
+
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' && i+1 < len(command) {
+				i++
+				text.WriteByte(command[i])
+			} else {
+				text.WriteByte(c)
+			}
+		case c == '\'' || c == '"':
+			if start < 0 {
+				start = i
+			}
+			quote = c
+		case c == '\\' && i+1 < len(command):
+			if start < 0 {
+				start = i
+			}
+			i++
+			if command[i] != '\n' {
+				text.WriteByte(command[i])
+			}
+		case c == ' ' || c == '\t':
+			endWord(i)
+		case strings.IndexByte(";&|()\n`", c) >= 0:
+			endWord(i)
+			endCommand()
+		default:
+			if start < 0 {
+				start = i
+			}
+			text.WriteByte(c)
+		}
+	}
+	endWord(len(command))
+	endCommand()
+
+	return commands
+}
+
+// commandPrefixes are words that may precede the program of a simple command.
+var commandPrefixes = map[string]bool{
+	"!": true, "if": true, "then": true, "else": true, "elif": true,
+	"while": true, "until": true, "do": true, "time": true,
+	"sudo": true, "exec": true, "nohup": true, "env": true,
+}
+
+// programOf returns the word naming the program of a simple command and the
+// words following it. Leading variable assignments and prefixes such as sudo
+// are skipped.
+func programOf(words []word) (*word, []word) {
+	for i := range words {
+		w := words[i].text
+		if commandPrefixes[w] || isAssignment(w) {
+			continue
+		}
+		return &words[i], words[i+1:]
+	}
+	return nil, nil
+}
+
+func isAssignment(w string) bool {
+	name, _, ok := strings.Cut(w, "=")
+	if !ok || name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c != '_' && (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func hasAnyWord(words []word, candidates []string) bool {
+	for _, w := range words {
+		for _, c := range candidates {
+			if w.text == c {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,254 @@
+// Package facts gathers information about the host a client runs on.
+package facts
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Gather collects the built-in facts of the local host. Facts that cannot be
+// determined on this platform are left out. The keys are:
+//
+//	hostname, os, os_family, distribution, distribution_version,
+//	distribution_name, kernel, architecture, package_manager, cpu_count,
+//	memory_total_mb, interfaces, ipv4_addresses, ipv6_addresses,
+//	machine_id, uptime_seconds
+func Gather() map[string]interface{} {
+	facts := map[string]interface{}{
+		"os":           runtime.GOOS,
+		"architecture": architecture(),
+		"cpu_count":    runtime.NumCPU(),
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		facts["hostname"] = hostname
+	}
+
+	for key, value := range distribution() {
+		facts[key] = value
+	}
+
+	if kernel := kernel(); kernel != "" {
+		facts["kernel"] = kernel
+	}
+	if pm := packageManager(); pm != "" {
+		facts["package_manager"] = pm
+	}
+	if mem, ok := memoryTotalMB(); ok {
+		facts["memory_total_mb"] = mem
+	}
+	if id := machineID(); id != "" {
+		facts["machine_id"] = id
+	}
+	if uptime, ok := uptimeSeconds(); ok {
+		facts["uptime_seconds"] = uptime
+	}
+
+	interfaces, ipv4, ipv6 := network()
+	facts["interfaces"] = interfaces
+	facts["ipv4_addresses"] = ipv4
+	facts["ipv6_addresses"] = ipv6
+
+	return facts
+}
+
+// architecture reports the machine architecture using the names of uname -m.
+func architecture() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	case "386":
+		return "i386"
+	}
+	return runtime.GOARCH
+}
+
+// distribution reads /etc/os-release, falling back to sw_vers on macOS.
+func distribution() map[string]interface{} {
+	if runtime.GOOS == "darwin" {
+		facts := map[string]interface{}{
+			"distribution": "macos",
+			"os_family":    "darwin",
+		}
+		if version := commandOutput("sw_vers", "-productVersion"); version != "" {
+			facts["distribution_version"] = version
+		}
+		return facts
+	}
+
+	release, err := parseOSRelease("/etc/os-release")
+	if err != nil {
+		if release, err = parseOSRelease("/usr/lib/os-release"); err != nil {
+			return nil
+		}
+	}
+
+	facts := map[string]interface{}{
+		"distribution":         release["ID"],
+		"distribution_version": release["VERSION_ID"],
+		"distribution_name":    release["PRETTY_NAME"],
+		"os_family":            osFamily(release["ID"], release["ID_LIKE"]),
+	}
+	return facts
+}
+
+// osFamily maps a distribution to the family whose tooling it shares, e.g.
+// ubuntu to debian and rocky to rhel.
+func osFamily(id, idLike string) string {
+	candidates := append([]string{id}, strings.Fields(idLike)...)
+	for _, family := range []string{"debian", "rhel", "suse", "arch", "alpine", "fedora"} {
+		for _, candidate := range candidates {
+			if candidate == family || (family == "suse" && strings.HasPrefix(candidate, "opensuse")) {
+				return family
+			}
+		}
+	}
+	return id
+}
+
+func parseOSRelease(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	release := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `'"`)
+		}
+		release[key] = value
+	}
+	return release, scanner.Err()
+}
+
+func kernel() string {
+	if data, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	return commandOutput("uname", "-r")
+}
+
+// packageManager returns the first supported package manager found in PATH.
+func packageManager() string {
+	managers := []struct{ name, binary string }{
+		{"apt", "apt-get"},
+		{"dnf", "dnf"},
+		{"yum", "yum"},
+		{"zypper", "zypper"},
+		{"pacman", "pacman"},
+		{"apk", "apk"},
+		{"brew", "brew"},
+	}
+	for _, m := range managers {
+		if _, err := exec.LookPath(m.binary); err == nil {
+			return m.name
+		}
+	}
+	return ""
+}
+
+func memoryTotalMB() (int, bool) {
+	if data, err := os.ReadFile("/proc/meminfo"); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "MemTotal:" {
+				kb, err := strconv.Atoi(fields[1])
+				return kb / 1024, err == nil
+			}
+		}
+	}
+	if out := commandOutput("sysctl", "-n", "hw.memsize"); out != "" {
+		bytes, err := strconv.ParseInt(out, 10, 64)
+		return int(bytes / 1024 / 1024), err == nil
+	}
+	return 0, false
+}
+
+func machineID() string {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if data, err := os.ReadFile(path); err == nil {
+			if id := strings.TrimSpace(string(data)); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+func uptimeSeconds() (int64, bool) {
+	if data, err := os.ReadFile("/proc/uptime"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) > 0 {
+			seconds, err := strconv.ParseFloat(fields[0], 64)
+			return int64(seconds), err == nil
+		}
+	}
+	return 0, false
+}
+
+// network lists the interfaces of the host and its non-loopback addresses.
+func network() ([]map[string]interface{}, []string, []string) {
+	var interfaces []map[string]interface{}
+	ipv4 := []string{}
+	ipv6 := []string{}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return interfaces, ipv4, ipv6
+	}
+
+	for _, iface := range ifaces {
+		addresses := []string{}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			addresses = append(addresses, ipnet.String())
+			if ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if ipnet.IP.To4() != nil {
+				ipv4 = append(ipv4, ipnet.IP.String())
+			} else {
+				ipv6 = append(ipv6, ipnet.IP.String())
+			}
+		}
+
+		interfaces = append(interfaces, map[string]interface{}{
+			"name":      iface.Name,
+			"mac":       iface.HardwareAddr.String(),
+			"mtu":       iface.MTU,
+			"up":        iface.Flags&net.FlagUp != 0,
+			"addresses": addresses,
+		})
+	}
+	return interfaces, ipv4, ipv6
+}
+
+// commandOutput runs a command and returns its trimmed output, or an empty
+// string if it fails.
+func commandOutput(name string, args ...string) string {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,153 @@
+package facts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// GatherLocal collects site-specific facts from dir, usually
+// /etc/for/facts.d. Static *.json, *.yml and *.yaml files are parsed and
+// executables are run and must print JSON on stdout. Each result is stored
+// under the file name without its extension, so /etc/for/facts.d/rack.json
+// becomes local.rack.
+//
+// Executables run concurrently and are killed after timeout. A file that
+// cannot be read, parsed or run is logged and left out, so one broken fact
+// script does not affect the others or the run.
+func GatherLocal(dir string, timeout time.Duration) map[string]interface{} {
+	local := make(map[string]interface{})
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error reading facts directory %s: %v", dir, err)
+		}
+		return local
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		ext := filepath.Ext(entry.Name())
+		name := strings.TrimSuffix(entry.Name(), ext)
+
+		switch {
+		case ext == ".json" || ext == ".yml" || ext == ".yaml":
+			value, err := readStatic(path)
+			if err != nil {
+				log.Printf("Error reading fact file %s: %v", path, err)
+				continue
+			}
+			mu.Lock()
+			local[name] = value
+			mu.Unlock()
+
+		case info.Mode()&0111 != 0:
+			wg.Add(1)
+			go func(path, name string) {
+				defer wg.Done()
+				value, err := runFactScript(path, timeout)
+				if err != nil {
+					log.Printf("Error running fact script %s: %v", path, err)
+					return
+				}
+				mu.Lock()
+				local[name] = value
+				mu.Unlock()
+			}(path, name)
+		}
+	}
+	wg.Wait()
+
+	return local
+}
+
+func readStatic(path string) (interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	if filepath.Ext(path) == ".json" {
+		err = json.Unmarshal(data, &value)
+	} else {
+		err = yaml.Unmarshal(data, &value)
+		value = stringKeys(value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Facts are sent to the server as JSON, which must not fail on one file
+	if _, err := json.Marshal(value); err != nil {
+		return nil, fmt.Errorf("cannot be sent as JSON: %v", err)
+	}
+	return value, nil
+}
+
+// stringKeys converts the keys of YAML maps, which may be numbers or other
+// scalars, to strings as JSON requires.
+func stringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = stringKeys(elem)
+		}
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			converted[fmt.Sprint(key)] = stringKeys(elem)
+		}
+		return converted
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = stringKeys(elem)
+		}
+	}
+	return value
+}
+
+// runFactScript runs an executable fact and decodes the JSON it prints.
+func runFactScript(path string, timeout time.Duration) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Don't wait for children that keep the output open after a kill
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("timed out after %s", timeout)
+		}
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(stdout.Bytes(), &value); err != nil {
+		return nil, fmt.Errorf("invalid JSON output: %v", err)
+	}
+	return value, nil
+}
@@ -1,6 +1,29 @@
 package models
 
-import "time"
+import (
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StringList is a list of strings that may also be written as a single
+// string in YAML.
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = StringList{value.Value}
+		return nil
+	}
+
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
 
 // Task represents a single task to be executed
 type Task struct {
@@ -10,33 +33,365 @@ type Task struct {
 	Variables   map[string]string `json:"variables,omitempty" yaml:"variables,omitempty"`
 	Description string            `json:"description,omitempty" yaml:"description,omitempty"`
 	Env         map[string]string `json:"env,omitempty" yaml:"env,omitempty"`
+
+	// PackageManagerDefaults overrides the command policy of the
+	// environment for this task; none runs the command exactly as written
+	PackageManagerDefaults string `json:"package_manager_defaults,omitempty" yaml:"package_manager_defaults,omitempty"`
+
+	// ChangedWhen and FailedWhen are conditions on the result of the task,
+	// e.g. rc in [0, 2], that decide its status instead of the exit code
+	ChangedWhen string `json:"changed_when,omitempty" yaml:"changed_when,omitempty"`
+	FailedWhen  string `json:"failed_when,omitempty" yaml:"failed_when,omitempty"`
+
+	// Register names the variable the result of the task is stored in for
+	// the tasks after it in the same run
+	Register string `json:"register,omitempty" yaml:"register,omitempty"`
+
+	// Loop runs the task once per item of a list or map, given inline or as
+	// a ${...} reference; the server sends the resolved list of items
+	Loop interface{} `json:"loop,omitempty" yaml:"loop,omitempty"`
+
+	// Timeout is how long the task may run, e.g. 10m, instead of the
+	// client's default
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+
+	// Block groups tasks that share the when condition and variables of the
+	// block. Rescue runs if a task of the block fails, Always in any case
+	Block  []Task `json:"block,omitempty" yaml:"block,omitempty"`
+	Rescue []Task `json:"rescue,omitempty" yaml:"rescue,omitempty"`
+	Always []Task `json:"always,omitempty" yaml:"always,omitempty"`
+
+	// Typed modules; a task uses either a command or one module
+	Modules `yaml:",inline"`
+	// Guards skip a command task if it has nothing to do
+	Guards `yaml:",inline"`
+
+	// Vars holds the values of the variables referenced by the task's
+	// conditions, resolved by the server for the client
+	Vars map[string]interface{} `json:"vars,omitempty" yaml:"-"`
+	// Deferred is set if the task references registered results, which the
+	// client renders before running it
+	Deferred bool `json:"deferred,omitempty" yaml:"-"`
+	// Role is the directory of the role the task belongs to, relative to
+	// the environments directory, e.g. customer1/roles/mariadb
+	Role string `json:"role,omitempty" yaml:"-"`
+	// Line is the line of the task in the YAML file it was loaded from
+	Line     int            `json:"-" yaml:"-"`
+	keyLines map[string]int // line of each key of the task
+}
+
+func (t *Task) UnmarshalYAML(value *yaml.Node) error {
+	type plain Task
+	if err := value.Decode((*plain)(t)); err != nil {
+		return err
+	}
+
+	t.Line = value.Line
+	t.keyLines = make(map[string]int, len(value.Content)/2)
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		t.keyLines[value.Content[i].Value] = value.Content[i].Line
+	}
+	return nil
+}
+
+// KeyLine returns the line of a key of the task in its YAML file, or the line
+// of the task itself if the key is not present.
+func (t Task) KeyLine(key string) int {
+	if line, ok := t.keyLines[key]; ok {
+		return line
+	}
+	return t.Line
+}
+
+// Keys returns the keys of the task in its YAML file, sorted.
+func (t Task) Keys() []string {
+	keys := make([]string, 0, len(t.keyLines))
+	for key := range t.keyLines {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Conditions returns the conditions of the task by key.
+func (t Task) Conditions() map[string]string {
+	conditions := make(map[string]string, 3)
+	for key, src := range map[string]string{"when": t.When, "changed_when": t.ChangedWhen, "failed_when": t.FailedWhen} {
+		if src != "" {
+			conditions[key] = src
+		}
+	}
+	return conditions
+}
+
+// Modules holds the arguments of the typed modules of a task.
+type Modules struct {
+	Package     *PackageSpec     `json:"package,omitempty" yaml:"package,omitempty"`
+	Service     *ServiceSpec     `json:"service,omitempty" yaml:"service,omitempty"`
+	File        *FileSpec        `json:"file,omitempty" yaml:"file,omitempty"`
+	Template    *TemplateSpec    `json:"template,omitempty" yaml:"template,omitempty"`
+	LineInFile  *LineInFileSpec  `json:"lineinfile,omitempty" yaml:"lineinfile,omitempty"`
+	BlockInFile *BlockInFileSpec `json:"blockinfile,omitempty" yaml:"blockinfile,omitempty"`
+	User        *UserSpec        `json:"user,omitempty" yaml:"user,omitempty"`
+	Group       *GroupSpec       `json:"group,omitempty" yaml:"group,omitempty"`
+	Cron        *CronSpec        `json:"cron,omitempty" yaml:"cron,omitempty"`
+	Sysctl      *SysctlSpec      `json:"sysctl,omitempty" yaml:"sysctl,omitempty"`
+	GetURL      *GetURLSpec      `json:"get_url,omitempty" yaml:"get_url,omitempty"`
+	Unarchive   *UnarchiveSpec   `json:"unarchive,omitempty" yaml:"unarchive,omitempty"`
+	// Module names an external module, an executable that gets Args as JSON
+	// on stdin
+	Module string                 `json:"module,omitempty" yaml:"module,omitempty"`
+	Args   map[string]interface{} `json:"args,omitempty" yaml:"args,omitempty"`
+}
+
+// Guards make command tasks idempotent. A task is skipped unless all of its
+// guards let it run.
+type Guards struct {
+	// Creates skips the command if this path (or glob) exists
+	Creates string `json:"creates,omitempty" yaml:"creates,omitempty"`
+	// Removes skips the command unless this path (or glob) exists
+	Removes string `json:"removes,omitempty" yaml:"removes,omitempty"`
+	// Unless skips the command if this check command exits with code 0
+	Unless string `json:"unless,omitempty" yaml:"unless,omitempty"`
+	// OnlyIf skips the command unless this check command exits with code 0
+	OnlyIf string `json:"onlyif,omitempty" yaml:"onlyif,omitempty"`
+}
+
+// PackageSpec describes the packages managed by a package task
+type PackageSpec struct {
+	Name StringList `json:"name" yaml:"name"`
+	// State is present (default), absent or latest
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+	// Version pins the version of a single package
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+	// UpdateCache refreshes the package index before installing
+	UpdateCache bool `json:"update_cache,omitempty" yaml:"update_cache,omitempty"`
+	// Use overrides the package manager detected from the host's facts
+	Use string `json:"use,omitempty" yaml:"use,omitempty"`
+}
+
+// ServiceSpec describes the desired state of a systemd unit
+type ServiceSpec struct {
+	Name string `json:"name" yaml:"name"`
+	// State is started, stopped, restarted or reloaded
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+	// Enabled starts the unit at boot if true and not if false
+	Enabled *bool `json:"enabled,omitempty" yaml:"enabled,omitempty"`
+	// DaemonReload reloads the systemd configuration first
+	DaemonReload bool `json:"daemon_reload,omitempty" yaml:"daemon_reload,omitempty"`
+}
+
+// FileSpec describes the desired state of a file, directory or symlink
+type FileSpec struct {
+	Path string `json:"path" yaml:"path"`
+	// State is file (default), directory, link, absent or touch
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+	Owner string `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Group string `json:"group,omitempty" yaml:"group,omitempty"`
+	// Mode is an octal permission string such as 0644
+	Mode string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// Content is the content of the file; a nil Content leaves it alone
+	Content *string `json:"content,omitempty" yaml:"content,omitempty"`
+	// Source is a file below the files/ directory of the task's role that
+	// is fetched from the server as content
+	Source string `json:"source,omitempty" yaml:"source,omitempty"`
+	// Target is what a link points to
+	Target string `json:"target,omitempty" yaml:"target,omitempty"`
+}
+
+// TemplateSpec describes a file rendered from a template of the task's role
+type TemplateSpec struct {
+	// Source is the template below the role's templates/ directory
+	Source string `json:"source" yaml:"source"`
+	// Path is where the rendered file is written
+	Path  string `json:"path" yaml:"path"`
+	Owner string `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Group string `json:"group,omitempty" yaml:"group,omitempty"`
+	Mode  string `json:"mode,omitempty" yaml:"mode,omitempty"`
+}
+
+// LineInFileSpec describes a single line of an existing file
+type LineInFileSpec struct {
+	Path string `json:"path" yaml:"path"`
+	// Regexp selects the line to replace or, with state absent, the lines
+	// to remove
+	Regexp string `json:"regexp,omitempty" yaml:"regexp,omitempty"`
+	Line   string `json:"line,omitempty" yaml:"line,omitempty"`
+	// State is present (default) or absent
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+	// InsertAfter and InsertBefore are regular expressions selecting where
+	// a new line goes, or EOF and BOF; the default is the end of the file
+	InsertAfter  string `json:"insertafter,omitempty" yaml:"insertafter,omitempty"`
+	InsertBefore string `json:"insertbefore,omitempty" yaml:"insertbefore,omitempty"`
+	// Create creates the file if it does not exist
+	Create bool `json:"create,omitempty" yaml:"create,omitempty"`
+	// Backup keeps a copy of the file before it is changed
+	Backup bool `json:"backup,omitempty" yaml:"backup,omitempty"`
+}
+
+// BlockInFileSpec describes a block of lines between two marker lines in an
+// existing file
+type BlockInFileSpec struct {
+	Path  string `json:"path" yaml:"path"`
+	Block string `json:"block,omitempty" yaml:"block,omitempty"`
+	// Marker is the marker line template; {mark} is replaced with BEGIN and
+	// END
+	Marker string `json:"marker,omitempty" yaml:"marker,omitempty"`
+	// State is present (default) or absent
+	State        string `json:"state,omitempty" yaml:"state,omitempty"`
+	InsertAfter  string `json:"insertafter,omitempty" yaml:"insertafter,omitempty"`
+	InsertBefore string `json:"insertbefore,omitempty" yaml:"insertbefore,omitempty"`
+	Create       bool   `json:"create,omitempty" yaml:"create,omitempty"`
+	Backup       bool   `json:"backup,omitempty" yaml:"backup,omitempty"`
+}
+
+// UserSpec describes a local user account
+type UserSpec struct {
+	Name string `json:"name" yaml:"name"`
+	UID  *int   `json:"uid,omitempty" yaml:"uid,omitempty"`
+	// Group is the primary group, as a name or gid
+	Group string `json:"group,omitempty" yaml:"group,omitempty"`
+	// Groups are the supplementary groups; the user is removed from other
+	// groups unless Append is set
+	Groups  StringList `json:"groups,omitempty" yaml:"groups,omitempty"`
+	Append  bool       `json:"append,omitempty" yaml:"append,omitempty"`
+	Comment string     `json:"comment,omitempty" yaml:"comment,omitempty"`
+	Shell   string     `json:"shell,omitempty" yaml:"shell,omitempty"`
+	Home    string     `json:"home,omitempty" yaml:"home,omitempty"`
+	// System creates a system account, without a home directory
+	System bool `json:"system,omitempty" yaml:"system,omitempty"`
+	// State is present (default) or absent
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+	// Remove deletes the home directory along with the user
+	Remove bool `json:"remove,omitempty" yaml:"remove,omitempty"`
+	// AuthorizedKeys is the content of the user's ~/.ssh/authorized_keys
+	AuthorizedKeys *string `json:"authorized_keys,omitempty" yaml:"authorized_keys,omitempty"`
+}
+
+// GroupSpec describes a local group
+type GroupSpec struct {
+	Name   string `json:"name" yaml:"name"`
+	GID    *int   `json:"gid,omitempty" yaml:"gid,omitempty"`
+	System bool   `json:"system,omitempty" yaml:"system,omitempty"`
+	// State is present (default) or absent
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+}
+
+// CronSpec describes a named cron job
+type CronSpec struct {
+	// Name identifies the entry; it is kept in a comment above the job
+	Name string `json:"name" yaml:"name"`
+	Job  string `json:"job,omitempty" yaml:"job,omitempty"`
+	// The schedule fields default to *
+	Minute  string `json:"minute,omitempty" yaml:"minute,omitempty"`
+	Hour    string `json:"hour,omitempty" yaml:"hour,omitempty"`
+	Day     string `json:"day,omitempty" yaml:"day,omitempty"`
+	Month   string `json:"month,omitempty" yaml:"month,omitempty"`
+	Weekday string `json:"weekday,omitempty" yaml:"weekday,omitempty"`
+	// Special is a schedule such as @reboot or @daily used instead of the
+	// schedule fields
+	Special string `json:"special,omitempty" yaml:"special,omitempty"`
+	// User runs the job; it defaults to root
+	User string `json:"user,omitempty" yaml:"user,omitempty"`
+	// File puts the job into /etc/cron.d/<file> instead of the user's
+	// crontab
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+	// State is present (default) or absent
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+}
+
+// SysctlSpec describes a kernel parameter
+type SysctlSpec struct {
+	Name  string `json:"name" yaml:"name"`
+	Value string `json:"value,omitempty" yaml:"value,omitempty"`
+	// State is present (default) or absent, which removes the persistent
+	// setting
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+	// File is the file below /etc/sysctl.d the setting is persisted in
+	File string `json:"file,omitempty" yaml:"file,omitempty"`
+}
+
+// GetURLSpec describes a file downloaded over HTTP(S)
+type GetURLSpec struct {
+	URL  string `json:"url" yaml:"url"`
+	Dest string `json:"dest" yaml:"dest"`
+	// Checksum is the expected SHA-256 of the file, as sha256:<hex> or
+	// plain hex
+	Checksum string `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+	// Force downloads the file again even if dest exists without a
+	// checksum to compare against
+	Force bool   `json:"force,omitempty" yaml:"force,omitempty"`
+	Owner string `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Group string `json:"group,omitempty" yaml:"group,omitempty"`
+	Mode  string `json:"mode,omitempty" yaml:"mode,omitempty"`
+}
+
+// UnarchiveSpec describes an archive on the host extracted into a directory
+type UnarchiveSpec struct {
+	// Source is a .tar, .tar.gz, .tgz, .tar.bz2, .tar.xz or .zip file
+	Source string `json:"source" yaml:"source"`
+	Dest   string `json:"dest" yaml:"dest"`
+	// Creates skips the task if this path exists
+	Creates string `json:"creates,omitempty" yaml:"creates,omitempty"`
+	// StripComponents removes this many leading path components from the
+	// archive's entries, like tar --strip-components
+	StripComponents int    `json:"strip_components,omitempty" yaml:"strip_components,omitempty"`
+	Owner           string `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Group           string `json:"group,omitempty" yaml:"group,omitempty"`
 }
 
 // Playbook represents a collection of tasks
 type Playbook struct {
-	Name        string   `json:"name" yaml:"name"`
-	Description string   `json:"description" yaml:"description"`
-	Hosts       []string `json:"hosts" yaml:"hosts"`
-	Customer    string   `json:"customer" yaml:"customer"`
-	Environment string   `json:"environment" yaml:"environment"`
-	Tasks       []Task   `json:"tasks" yaml:"tasks"`
+	Name         string     `json:"name" yaml:"name"`
+	Description  string     `json:"description" yaml:"description"`
+	Hosts        []string   `json:"hosts" yaml:"hosts"`
+	Customer     string     `json:"customer" yaml:"customer"`
+	Environment  string     `json:"environment" yaml:"environment"`
+	IncludeRoles []string   `json:"include_roles,omitempty" yaml:"include_roles,omitempty"`
+	Include      StringList `json:"include,omitempty" yaml:"include,omitempty"`
+	Tasks        []Task     `json:"tasks" yaml:"tasks"`
 }
 
 // Environment represents a collection of playbooks and their configurations
 type Environment struct {
-	Name        string               `yaml:"name" json:"name"`
-	Description string               `yaml:"description" json:"description"`
-	Variables   map[string]string    `yaml:"variables,omitempty" json:"variables,omitempty"`
-	Playbooks   map[string]Playbook  `yaml:"playbooks" json:"playbooks"`
+	Name        string              `yaml:"name" json:"name"`
+	Description string              `yaml:"description" json:"description"`
+	Variables   map[string]string   `yaml:"variables,omitempty" json:"variables,omitempty"`
+	Playbooks   map[string]Playbook `yaml:"playbooks" json:"playbooks"`
+	// PackageManagerDefaults is the policy used to rewrite package manager
+	// commands, e.g. noninteractive; by default commands run as written
+	PackageManagerDefaults string `yaml:"package_manager_defaults,omitempty" json:"package_manager_defaults,omitempty"`
+	// Sections holds the free-form role configuration sections (e.g. mariadb:)
+	Sections map[string]interface{} `yaml:",inline" json:"sections,omitempty"`
 }
 
 // TaskResult represents the result of executing a task
 type TaskResult struct {
-	Name       string        `json:"name"`
-	Changed    bool          `json:"changed"`
-	Failed     bool          `json:"failed"`
-	SkipReason string        `json:"skip_reason,omitempty"`
-	Output     string        `json:"output"`
+	Name       string `json:"name"`
+	Changed    bool   `json:"changed"`
+	Failed     bool   `json:"failed"`
+	SkipReason string `json:"skip_reason,omitempty"`
+	Command    string `json:"command,omitempty"`
+	Output     string `json:"output"`
+	// Stdout, Stderr and ExitCode are set for commands; ExitCode is -1 if
+	// the command was stopped by a signal, e.g. on timeout
+	Stdout   string `json:"stdout,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	// OutputFile is the spool file with the full output if stdout or
+	// stderr were truncated; the server fetches it from the client on demand
+	OutputFile string        `json:"output_file,omitempty"`
+	Diff       string        `json:"diff,omitempty"`
+	StartedAt  time.Time     `json:"started_at"`
+	EndedAt    time.Time     `json:"ended_at"`
 	Duration   time.Duration `json:"duration"`
 	Error      string        `json:"error,omitempty"`
+	// TimedOut is set if the task was stopped because it ran into its timeout
+	TimedOut bool `json:"timed_out,omitempty"`
+	// Rescued is set on a failed task of a block whose rescue tasks succeeded
+	Rescued bool `json:"rescued,omitempty"`
+	// Item is the loop item of a sub-result; Results holds the result of
+	// every item of a loop task
+	Item    interface{}  `json:"item,omitempty"`
+	Results []TaskResult `json:"results,omitempty"`
 }
@@ -0,0 +1,74 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/diceone/for-IT/internal/models"
+)
+
+const defaultMarker = "# {mark} FOR MANAGED BLOCK"
+
+func validateBlockInFile(spec *models.BlockInFileSpec) error {
+	if err := validateEditPath(spec.Path); err != nil {
+		return err
+	}
+	switch spec.State {
+	case "", "present", "absent":
+	default:
+		return fmt.Errorf("state must be present or absent, not %q", spec.State)
+	}
+	if spec.Marker != "" && (!strings.Contains(spec.Marker, "{mark}") || strings.Contains(spec.Marker, "\n")) {
+		return fmt.Errorf("marker must be a single line containing {mark}")
+	}
+	return validateInsert(spec.InsertAfter, spec.InsertBefore)
+}
+
+// runBlockInFile keeps the lines between a BEGIN and an END marker line
+// equal to the block. A missing block is inserted together with its
+// markers.
+func runBlockInFile(h *Host, spec *models.BlockInFileSpec) (Result, error) {
+	marker := spec.Marker
+	if marker == "" {
+		marker = defaultMarker
+	}
+	begin := strings.ReplaceAll(marker, "{mark}", "BEGIN")
+	end := strings.ReplaceAll(marker, "{mark}", "END")
+
+	return editFile(h, spec.Path, spec.Create, spec.Backup, func(lines []string) ([]string, string, error) {
+		start, stop := -1, -1
+		for i, line := range lines {
+			if line == begin && start < 0 {
+				start = i
+			} else if line == end && start >= 0 {
+				stop = i
+				break
+			}
+		}
+		if start >= 0 && stop < 0 {
+			return nil, "", fmt.Errorf("%s has a BEGIN marker without an END marker", spec.Path)
+		}
+		found := start >= 0
+
+		if spec.State == "absent" {
+			if !found {
+				return lines, "", nil
+			}
+			return append(append([]string(nil), lines[:start]...), lines[stop+1:]...), "removed block", nil
+		}
+
+		block := append([]string{begin}, splitLines(spec.Block)...)
+		block = append(block, end)
+		if !found {
+			at, err := insertPosition(lines, spec.InsertAfter, spec.InsertBefore)
+			if err != nil {
+				return nil, "", err
+			}
+			return insertLines(lines, at, block...), "inserted block", nil
+		}
+
+		edited := append(append([]string(nil), lines[:start]...), block...)
+		edited = append(edited, lines[stop+1:]...)
+		return edited, "updated block", nil
+	})
+}
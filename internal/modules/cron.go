@@ -0,0 +1,199 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/diceone/for-IT/internal/diff"
+	"github.com/diceone/for-IT/internal/models"
+)
+
+// cronDir holds the system crontab files managed with file:.
+var cronDir = "/etc/cron.d"
+
+// cronMarker precedes every managed cron job and identifies it by name.
+const cronMarker = "# for: "
+
+var specialSchedules = map[string]bool{
+	"@reboot": true, "@yearly": true, "@annually": true, "@monthly": true,
+	"@weekly": true, "@daily": true, "@midnight": true, "@hourly": true,
+}
+
+// cronFileName matches the file names cron reads from /etc/cron.d.
+var cronFileName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func validateCron(spec *models.CronSpec) error {
+	if spec.Name == "" || strings.Contains(spec.Name, "\n") {
+		return fmt.Errorf("name is required and must be a single line")
+	}
+	switch spec.State {
+	case "", "present":
+		if spec.Job == "" || strings.Contains(spec.Job, "\n") {
+			return fmt.Errorf("job is required and must be a single line")
+		}
+	case "absent":
+	default:
+		return fmt.Errorf("state must be present or absent, not %q", spec.State)
+	}
+
+	fields := []string{spec.Minute, spec.Hour, spec.Day, spec.Month, spec.Weekday}
+	if spec.Special != "" {
+		if !specialSchedules[spec.Special] {
+			return fmt.Errorf("unknown special schedule %q", spec.Special)
+		}
+		if strings.Join(fields, "") != "" {
+			return fmt.Errorf("special cannot be combined with minute, hour, day, month or weekday")
+		}
+	}
+	for _, field := range fields {
+		if strings.ContainsAny(field, " \t\n") {
+			return fmt.Errorf("invalid schedule field %q", field)
+		}
+	}
+
+	if spec.User != "" {
+		if err := validAccountName(spec.User); err != nil {
+			return fmt.Errorf("user: %v", err)
+		}
+	}
+	if spec.File != "" && !cronFileName.MatchString(spec.File) {
+		return fmt.Errorf("file must be a plain name of letters, digits, _ and -, as cron ignores other files")
+	}
+	return nil
+}
+
+// cronEntry returns the crontab line of a job. Lines in /etc/cron.d name the
+// user the job runs as.
+func cronEntry(spec *models.CronSpec) string {
+	schedule := spec.Special
+	if schedule == "" {
+		fields := []string{spec.Minute, spec.Hour, spec.Day, spec.Month, spec.Weekday}
+		for i, field := range fields {
+			if field == "" {
+				fields[i] = "*"
+			}
+		}
+		schedule = strings.Join(fields, " ")
+	}
+	if spec.File != "" {
+		return fmt.Sprintf("%s %s %s", schedule, cronUser(spec), spec.Job)
+	}
+	return fmt.Sprintf("%s %s", schedule, spec.Job)
+}
+
+func cronUser(spec *models.CronSpec) string {
+	if spec.User == "" {
+		return "root"
+	}
+	return spec.User
+}
+
+// editCron sets or removes the job named by spec in the lines of a crontab.
+func editCron(spec *models.CronSpec) func(lines []string) ([]string, string, error) {
+	return func(lines []string) ([]string, string, error) {
+		marker := cronMarker + spec.Name
+		at := -1
+		for i, line := range lines {
+			if line == marker {
+				at = i
+				break
+			}
+		}
+
+		if spec.State == "absent" {
+			if at < 0 {
+				return lines, "", nil
+			}
+			end := at + 1
+			if end < len(lines) {
+				end++
+			}
+			return append(append([]string(nil), lines[:at]...), lines[end:]...), "removed job " + spec.Name, nil
+		}
+
+		entry := cronEntry(spec)
+		switch {
+		case at < 0:
+			return append(append([]string(nil), lines...), marker, entry), "added job " + spec.Name, nil
+		case at+1 < len(lines) && lines[at+1] == entry:
+			return lines, "", nil
+		case at+1 < len(lines):
+			edited := append([]string(nil), lines...)
+			edited[at+1] = entry
+			return edited, "updated job " + spec.Name, nil
+		default:
+			return append(append([]string(nil), lines...), entry), "updated job " + spec.Name, nil
+		}
+	}
+}
+
+func runCron(h *Host, spec *models.CronSpec) (Result, error) {
+	if spec.File != "" {
+		path := filepath.Join(cronDir, spec.File)
+		if _, err := os.Stat(path); os.IsNotExist(err) && spec.State == "absent" {
+			return Result{Output: fmt.Sprintf("%s unchanged", path)}, nil
+		}
+		return editFile(h, path, true, false, editCron(spec))
+	}
+	return editCrontab(h, spec)
+}
+
+// editCrontab changes a job in a user's crontab with the crontab command.
+func editCrontab(h *Host, spec *models.CronSpec) (Result, error) {
+	user := cronUser(spec)
+	out, err := h.Executor.RunArgs(h.Context, nil, "crontab", "-l", "-u", user)
+	if err != nil {
+		return Result{}, err
+	}
+	current := out.Stdout
+	if out.ExitCode != 0 {
+		// crontab -l fails if the user has no crontab yet
+		if !strings.Contains(out.Stderr, "no crontab") {
+			return Result{}, fmt.Errorf("crontab -l -u %s exited with code %d: %s", user, out.ExitCode, out.Stderr)
+		}
+		current = ""
+	}
+	if current != "" {
+		current += "\n"
+	}
+
+	edited, action, err := editCron(spec)(splitLines(current))
+	if err != nil {
+		return Result{}, err
+	}
+	content := joinLines(edited)
+	name := fmt.Sprintf("crontab of %s", user)
+	if action == "" || content == current {
+		return Result{Output: fmt.Sprintf("%s unchanged", name)}, nil
+	}
+
+	result := Result{
+		Changed: true,
+		Output:  fmt.Sprintf("%s: %s", name, action),
+		Diff:    diff.Unified(name, name, current, content),
+	}
+	if h.DryRun {
+		result.Output = "would have " + result.Output
+		return result, nil
+	}
+
+	tmp, err := os.CreateTemp("", "for-crontab-*")
+	if err != nil {
+		return Result{}, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return Result{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return Result{}, err
+	}
+	if _, err := h.run(nil, "crontab", "-u", user, tmp.Name()); err != nil {
+		return Result{}, err
+	}
+	return result, nil
+}
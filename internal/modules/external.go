@@ -0,0 +1,146 @@
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/diceone/for-IT/internal/models"
+)
+
+// externalName matches the names of external modules, which are file names
+// in a role's library/ or the client's modules directory.
+var externalName = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// externalReply is what an external module prints as JSON on stdout.
+type externalReply struct {
+	Changed bool                   `json:"changed"`
+	Failed  bool                   `json:"failed"`
+	Msg     string                 `json:"msg"`
+	Diff    string                 `json:"diff"`
+	Facts   map[string]interface{} `json:"facts"`
+}
+
+func validateExternal(name string) error {
+	if !externalName.MatchString(name) {
+		return fmt.Errorf("invalid module name %q", name)
+	}
+	return nil
+}
+
+// runExternal runs an external module. The module gets the task's args as a
+// JSON object on stdin and replies with an externalReply on stdout. Like
+// commands, external modules are not run in a dry run as they might not
+// know how to check without changing anything.
+func runExternal(h *Host, task models.Task) (Result, error) {
+	path, cleanup, err := h.findModule(task.Role, task.Module)
+	if err != nil {
+		return Result{}, err
+	}
+	defer cleanup()
+
+	if h.DryRun {
+		return Result{Output: fmt.Sprintf("Would run module %s", task.Module)}, nil
+	}
+
+	args := task.Args
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+	input, err := json.Marshal(args)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to encode args of module %s: %v", task.Module, err)
+	}
+
+	out, err := h.Executor.RunInput(h.Context, nil, input, path)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to run module %s: %v", task.Module, err)
+	}
+
+	var reply externalReply
+	if err := json.Unmarshal([]byte(out.Stdout), &reply); err != nil {
+		if out.ExitCode != 0 {
+			msg := out.Stderr
+			if msg == "" {
+				msg = out.Stdout
+			}
+			return Result{}, fmt.Errorf("module %s exited with code %d: %s", task.Module, out.ExitCode, msg)
+		}
+		return Result{}, fmt.Errorf("module %s did not reply with JSON: %v", task.Module, err)
+	}
+
+	result := Result{Changed: reply.Changed, Output: reply.Msg, Diff: reply.Diff, Facts: reply.Facts}
+	if reply.Failed || out.ExitCode != 0 {
+		msg := reply.Msg
+		if msg == "" {
+			msg = fmt.Sprintf("module %s failed with exit code %d", task.Module, out.ExitCode)
+		}
+		result.Output = out.Stderr
+		return result, errors.New(msg)
+	}
+	return result, nil
+}
+
+// findModule returns the path of an external module. A module shipped in the
+// library/ directory of the task's role wins over one in the client's modules
+// directory. Modules fetched from the server are stored in a temporary file
+// in the staging directory that cleanup removes.
+func (h *Host) findModule(role, name string) (path string, cleanup func(), err error) {
+	cleanup = func() {}
+	if h.FetchFile != nil && role != "" {
+		data, err := h.FetchFile(role, "library", name)
+		if err == nil {
+			return writeModule(h.StagingDir, name, data)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", cleanup, fmt.Errorf("failed to fetch module %s: %v", name, err)
+		}
+	}
+
+	if h.ModulesDir != "" {
+		path = filepath.Join(h.ModulesDir, name)
+		info, err := os.Stat(path)
+		if err == nil && info.Mode().IsRegular() {
+			if info.Mode().Perm()&0111 == 0 {
+				return "", cleanup, fmt.Errorf("module %s is not executable", path)
+			}
+			return path, cleanup, nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return "", cleanup, err
+		}
+	}
+	return "", cleanup, fmt.Errorf("module %s not found in the library/ of the role or in %s", name, h.ModulesDir)
+}
+
+// writeModule stages a module in dir, which is created if needed. The
+// system's temporary directory is often mounted noexec, so it is not used.
+func writeModule(dir, name string, data []byte) (string, func(), error) {
+	if dir == "" {
+		return "", func() {}, fmt.Errorf("no staging directory for module %s", name)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", func() {}, err
+	}
+	f, err := os.CreateTemp(dir, name+"-*")
+	if err != nil {
+		return "", func() {}, err
+	}
+	cleanup := func() { os.Remove(f.Name()) }
+
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0700)
+	}
+	if err != nil {
+		cleanup()
+		return "", func() {}, err
+	}
+	return f.Name(), cleanup, nil
+}
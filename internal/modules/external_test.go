@@ -0,0 +1,54 @@
+package modules
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/diceone/for-IT/internal/executor"
+	"github.com/diceone/for-IT/internal/models"
+)
+
+func TestExternalStagedModule(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as module")
+	}
+	staging := filepath.Join(t.TempDir(), "modules")
+	script := `#!/bin/sh
+printf '{"changed": true, "msg": "%s", "facts": {"shop_db": "created"}}' "$0"
+`
+	h := &Host{
+		Context:    context.Background(),
+		Executor:   executor.NewExecutor(),
+		StagingDir: staging,
+		FetchFile: func(role, dir, path string) ([]byte, error) {
+			if role != "acme/roles/db" || dir != "library" || path != "mysql_db" {
+				return nil, os.ErrNotExist
+			}
+			return []byte(script), nil
+		},
+	}
+	task := models.Task{Role: "acme/roles/db", Modules: models.Modules{Module: "mysql_db"}}
+
+	result, err := runExternal(h, task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Changed || result.Facts["shop_db"] != "created" {
+		t.Errorf("result = %+v", result)
+	}
+	if filepath.Dir(result.Output) != staging {
+		t.Errorf("module ran as %q, want it in %q", result.Output, staging)
+	}
+	if entries, _ := os.ReadDir(staging); len(entries) != 0 {
+		t.Errorf("staged module was not removed: %v", entries)
+	}
+
+	h.StagingDir = ""
+	if _, err := runExternal(h, task); err == nil || !strings.Contains(err.Error(), "staging directory") {
+		t.Errorf("error without a staging directory = %v", err)
+	}
+}
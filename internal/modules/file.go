@@ -0,0 +1,478 @@
+package modules
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diceone/for-IT/internal/diff"
+	"github.com/diceone/for-IT/internal/models"
+)
+
+const (
+	defaultFileMode = 0644
+	defaultDirMode  = 0755
+)
+
+func validateFile(spec *models.FileSpec, role string) error {
+	if spec.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if !filepath.IsAbs(spec.Path) {
+		return fmt.Errorf("path %q must be absolute", spec.Path)
+	}
+
+	state := spec.State
+	if state == "" {
+		state = "file"
+	}
+	switch state {
+	case "file", "directory", "link", "absent", "touch":
+	default:
+		return fmt.Errorf("state must be file, directory, link, absent or touch, not %q", spec.State)
+	}
+
+	if spec.Content != nil && spec.Source != "" {
+		return fmt.Errorf("only one of content and source may be given")
+	}
+	if (spec.Content != nil || spec.Source != "") && state != "file" {
+		return fmt.Errorf("content and source require state file")
+	}
+	if spec.Source != "" && role == "" {
+		return fmt.Errorf("source is only available to tasks of a role")
+	}
+	if (spec.Target != "") != (state == "link") {
+		return fmt.Errorf("target is required for, and only allowed with, state link")
+	}
+	if state == "absent" && (spec.Owner != "" || spec.Group != "" || spec.Mode != "") {
+		return fmt.Errorf("owner, group and mode are not allowed with state absent")
+	}
+
+	if spec.Mode != "" {
+		if _, err := parseMode(spec.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseMode(mode string) (fs.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 07777 {
+		return 0, fmt.Errorf("invalid mode %q, expected an octal number such as 0644", mode)
+	}
+	perm := fs.FileMode(m & 0777)
+	if m&04000 != 0 {
+		perm |= fs.ModeSetuid
+	}
+	if m&02000 != 0 {
+		perm |= fs.ModeSetgid
+	}
+	if m&01000 != 0 {
+		perm |= fs.ModeSticky
+	}
+	return perm, nil
+}
+
+// fileChange collects what a file task did, or would do in a dry run.
+type fileChange struct {
+	actions []string
+	diff    string
+}
+
+func (c *fileChange) add(format string, args ...interface{}) {
+	c.actions = append(c.actions, fmt.Sprintf(format, args...))
+}
+
+func runFile(h *Host, spec *models.FileSpec, role string) (Result, error) {
+	change := &fileChange{}
+	var err error
+	switch spec.State {
+	case "", "file":
+		err = ensureFile(h, spec, role, change)
+	case "directory":
+		err = ensureDirectory(h, spec, change)
+	case "link":
+		err = ensureLink(h, spec, change)
+	case "absent":
+		err = ensureAbsent(h, spec, change)
+	case "touch":
+		err = touchFile(h, spec, change)
+	default:
+		err = fmt.Errorf("unknown state %q", spec.State)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	if len(change.actions) == 0 {
+		state := spec.State
+		if state == "" {
+			state = "file"
+		}
+		return Result{Output: fmt.Sprintf("%s already in state %s", spec.Path, state)}, nil
+	}
+
+	prefix := ""
+	if h.DryRun {
+		prefix = "would have "
+	}
+	return Result{
+		Changed: true,
+		Output:  fmt.Sprintf("%s%s: %s", prefix, spec.Path, strings.Join(change.actions, ", ")),
+		Diff:    change.diff,
+	}, nil
+}
+
+func ensureFile(h *Host, spec *models.FileSpec, role string, change *fileChange) error {
+	info, err := os.Lstat(spec.Path)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if exists && !info.Mode().IsRegular() {
+		return fmt.Errorf("%s exists and is not a regular file", spec.Path)
+	}
+
+	var content *string
+	switch {
+	case spec.Content != nil:
+		content = spec.Content
+	case spec.Source != "":
+		if h.FetchFile == nil {
+			return fmt.Errorf("source: no server to fetch files from")
+		}
+		data, err := h.FetchFile(role, "files", spec.Source)
+		if err != nil {
+			return fmt.Errorf("source %s: %v", spec.Source, err)
+		}
+		s := string(data)
+		content = &s
+	}
+
+	if !exists {
+		if content == nil {
+			content = new(string)
+		}
+		change.add("created")
+		change.diff = diff.Unified("/dev/null", spec.Path, "", *content)
+		if h.DryRun {
+			return nil
+		}
+		mode := fs.FileMode(defaultFileMode)
+		if spec.Mode != "" {
+			mode, _ = parseMode(spec.Mode)
+		}
+		if err := writeFileAtomic(spec.Path, []byte(*content), mode, -1, -1); err != nil {
+			return err
+		}
+		return ensureAttributes(h, spec, change, false)
+	}
+
+	if content != nil {
+		current, err := os.ReadFile(spec.Path)
+		if err != nil {
+			return err
+		}
+		if string(current) != *content {
+			change.add("content changed")
+			change.diff = diff.Unified(spec.Path, spec.Path, string(current), *content)
+			if !h.DryRun {
+				// Keep the attributes of the file being replaced
+				uid, gid := fileOwner(info)
+				if err := writeFileAtomic(spec.Path, []byte(*content), permBits(info.Mode()), uid, gid); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return ensureAttributes(h, spec, change, true)
+}
+
+func ensureDirectory(h *Host, spec *models.FileSpec, change *fileChange) error {
+	info, err := os.Lstat(spec.Path)
+	if err == nil && !info.IsDir() {
+		return fmt.Errorf("%s exists and is not a directory", spec.Path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if os.IsNotExist(err) {
+		change.add("created directory")
+		if h.DryRun {
+			return nil
+		}
+		mode := fs.FileMode(defaultDirMode)
+		if spec.Mode != "" {
+			mode, _ = parseMode(spec.Mode)
+		}
+		if err := os.MkdirAll(spec.Path, mode); err != nil {
+			return err
+		}
+		// MkdirAll applies the umask
+		if err := os.Chmod(spec.Path, mode); err != nil {
+			return err
+		}
+		return ensureAttributes(h, spec, change, false)
+	}
+	return ensureAttributes(h, spec, change, true)
+}
+
+func ensureLink(h *Host, spec *models.FileSpec, change *fileChange) error {
+	info, err := os.Lstat(spec.Path)
+	switch {
+	case err == nil && info.Mode()&fs.ModeSymlink != 0:
+		current, err := os.Readlink(spec.Path)
+		if err != nil {
+			return err
+		}
+		if current != spec.Target {
+			change.add("link target changed from %s to %s", current, spec.Target)
+		}
+	case err == nil && info.IsDir():
+		return fmt.Errorf("%s exists and is a directory", spec.Path)
+	case err == nil:
+		change.add("replaced file with link to %s", spec.Target)
+	case os.IsNotExist(err):
+		change.add("created link to %s", spec.Target)
+	default:
+		return err
+	}
+
+	if len(change.actions) > 0 && !h.DryRun {
+		// Create the link next to the old path and rename it over the old
+		// one so that the path never disappears
+		tmp := filepath.Join(filepath.Dir(spec.Path), fmt.Sprintf(".%s.for-%d", filepath.Base(spec.Path), time.Now().UnixNano()))
+		if err := os.Symlink(spec.Target, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, spec.Path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	if spec.Owner != "" || spec.Group != "" {
+		// A new link's owner is not reported separately, and in a dry run
+		// there is no link to check yet
+		created := len(change.actions) > 0
+		return ensureOwner(h, spec, change, !created || !h.DryRun, !created)
+	}
+	return nil
+}
+
+func ensureAbsent(h *Host, spec *models.FileSpec, change *fileChange) error {
+	info, err := os.Lstat(spec.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		change.add("removed directory")
+	case info.Mode().IsRegular():
+		change.add("removed")
+		if current, err := os.ReadFile(spec.Path); err == nil {
+			change.diff = diff.Unified(spec.Path, "/dev/null", string(current), "")
+		}
+	default:
+		change.add("removed")
+	}
+	if h.DryRun {
+		return nil
+	}
+	return os.RemoveAll(spec.Path)
+}
+
+// touchFile creates a file or updates its timestamps. It always counts as a
+// change.
+func touchFile(h *Host, spec *models.FileSpec, change *fileChange) error {
+	_, err := os.Lstat(spec.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exists := err == nil
+
+	if exists {
+		change.add("touched")
+	} else {
+		change.add("created")
+	}
+	if h.DryRun {
+		return ensureAttributes(h, spec, change, exists)
+	}
+
+	if exists {
+		now := time.Now()
+		if err := os.Chtimes(spec.Path, now, now); err != nil {
+			return err
+		}
+	} else {
+		mode := fs.FileMode(defaultFileMode)
+		if spec.Mode != "" {
+			mode, _ = parseMode(spec.Mode)
+		}
+		if err := writeFileAtomic(spec.Path, nil, mode, -1, -1); err != nil {
+			return err
+		}
+	}
+	return ensureAttributes(h, spec, change, exists)
+}
+
+// ensureAttributes sets the mode and ownership of spec.Path if they differ
+// from the spec. report is false if the path was just created, in which case
+// the attributes are set without being listed as separate changes.
+func ensureAttributes(h *Host, spec *models.FileSpec, change *fileChange, report bool) error {
+	if !report && h.DryRun {
+		return nil
+	}
+
+	if spec.Mode != "" {
+		mode, _ := parseMode(spec.Mode)
+		info, err := os.Stat(spec.Path)
+		if err != nil {
+			return err
+		}
+		current := permBits(info.Mode())
+		if current != mode {
+			if report {
+				change.add("mode changed from %s to %s", formatMode(current), formatMode(mode))
+			}
+			if !h.DryRun {
+				if err := os.Chmod(spec.Path, mode); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if spec.Owner != "" || spec.Group != "" {
+		return ensureOwner(h, spec, change, true, report)
+	}
+	return nil
+}
+
+// ensureOwner sets the owner and group of spec.Path, without following a
+// symlink, if they differ from the spec. check is false if the path does
+// not exist yet because it would only have been created in a dry run.
+func ensureOwner(h *Host, spec *models.FileSpec, change *fileChange, check, report bool) error {
+	uid, gid := -1, -1
+	var err error
+	if spec.Owner != "" {
+		if uid, err = lookupUser(spec.Owner); err != nil {
+			return err
+		}
+	}
+	if spec.Group != "" {
+		if gid, err = lookupGroup(spec.Group); err != nil {
+			return err
+		}
+	}
+	if !check {
+		return nil
+	}
+
+	info, err := os.Lstat(spec.Path)
+	if err != nil {
+		return err
+	}
+	currentUID, currentGID := fileOwner(info)
+	if uid == currentUID || uid == -1 {
+		uid = -1
+	} else if report {
+		change.add("owner changed to %s", spec.Owner)
+	}
+	if gid == currentGID || gid == -1 {
+		gid = -1
+	} else if report {
+		change.add("group changed to %s", spec.Group)
+	}
+
+	if (uid != -1 || gid != -1) && !h.DryRun {
+		return os.Lchown(spec.Path, uid, gid)
+	}
+	return nil
+}
+
+func lookupUser(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+func lookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// permBits returns the permission bits of mode including setuid, setgid and
+// sticky.
+func permBits(mode fs.FileMode) fs.FileMode {
+	return mode & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+}
+
+func formatMode(mode fs.FileMode) string {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 04000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 02000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 01000
+	}
+	return fmt.Sprintf("%04o", m)
+}
+
+// writeFileAtomic replaces path with data by writing a temporary file in the
+// same directory and renaming it, so readers never see a partial file. The
+// owner is only set if uid or gid is not -1.
+func writeFileAtomic(path string, data []byte, mode fs.FileMode, uid, gid int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".for-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Lchown(tmp.Name(), uid, gid); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package modules
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileOwner returns the owner and group of a file.
+func fileOwner(info fs.FileInfo) (uid, gid int) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid)
+	}
+	return -1, -1
+}
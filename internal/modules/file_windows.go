@@ -0,0 +1,8 @@
+package modules
+
+import "io/fs"
+
+// fileOwner returns -1 as files have no numeric owner on Windows.
+func fileOwner(info fs.FileInfo) (uid, gid int) {
+	return -1, -1
+}
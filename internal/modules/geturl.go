@@ -0,0 +1,170 @@
+package modules
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/diceone/for-IT/internal/models"
+)
+
+func validateGetURL(spec *models.GetURLSpec) error {
+	u, err := url.Parse(spec.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	if err := validateEditPath(spec.Dest); err != nil {
+		return fmt.Errorf("dest: %v", err)
+	}
+	if spec.Checksum != "" {
+		if _, err := parseChecksum(spec.Checksum); err != nil {
+			return err
+		}
+	}
+	if spec.Mode != "" {
+		if _, err := parseMode(spec.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseChecksum returns the hex SHA-256 of a checksum given as
+// sha256:<hex> or <hex>.
+func parseChecksum(checksum string) (string, error) {
+	sum := strings.ToLower(strings.TrimPrefix(checksum, "sha256:"))
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("checksum must be a SHA-256 as sha256:<64 hex digits>")
+	}
+	return sum, nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// runGetURL downloads a file unless dest already has the expected checksum
+// or, without a checksum, already exists. The download goes to a temporary
+// file that only replaces dest once it is complete and verified.
+func runGetURL(h *Host, spec *models.GetURLSpec) (Result, error) {
+	var want string
+	if spec.Checksum != "" {
+		want, _ = parseChecksum(spec.Checksum)
+	}
+	attrs := &models.FileSpec{Path: spec.Dest, Owner: spec.Owner, Group: spec.Group, Mode: spec.Mode}
+	change := &fileChange{}
+
+	info, err := os.Stat(spec.Dest)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return Result{}, err
+	}
+	if exists && !info.Mode().IsRegular() {
+		return Result{}, fmt.Errorf("%s exists and is not a regular file", spec.Dest)
+	}
+
+	var current string
+	if exists {
+		if current, err = fileSHA256(spec.Dest); err != nil {
+			return Result{}, err
+		}
+	}
+	download := !exists || (want != "" && current != want) || (want == "" && spec.Force)
+
+	if download && h.DryRun {
+		change.add("downloaded %s", spec.URL)
+	} else if download {
+		sum, err := fetchURL(h.Context, spec.URL, spec.Dest, want, spec.Mode)
+		if err != nil {
+			return Result{}, err
+		}
+		if sum != current {
+			change.add("downloaded %s", spec.URL)
+		}
+	}
+
+	// A new file gets the requested attributes without reporting them
+	if err := ensureAttributes(h, attrs, change, exists); err != nil {
+		return Result{}, err
+	}
+
+	if len(change.actions) == 0 {
+		return Result{Output: fmt.Sprintf("%s is up to date", spec.Dest)}, nil
+	}
+	prefix := ""
+	if h.DryRun {
+		prefix = "would have "
+	}
+	return Result{Changed: true, Output: fmt.Sprintf("%s%s: %s", prefix, spec.Dest, strings.Join(change.actions, ", "))}, nil
+}
+
+// fetchURL downloads rawURL into dest and returns its SHA-256. If want is
+// set the download must match it. An unchanged file is left alone.
+func fetchURL(ctx context.Context, rawURL, dest, want, mode string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: unexpected status code: %d", rawURL, resp.StatusCode)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".for-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", rawURL, err)
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if want != "" && sum != want {
+		return "", fmt.Errorf("%s: checksum mismatch: expected sha256:%s, got sha256:%s", rawURL, want, sum)
+	}
+	if current, err := fileSHA256(dest); err == nil && current == sum {
+		return sum, nil
+	}
+
+	perm := os.FileMode(defaultFileMode)
+	if info, err := os.Stat(dest); err == nil {
+		perm = permBits(info.Mode())
+	} else if mode != "" {
+		perm, _ = parseMode(mode)
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return "", err
+	}
+	return sum, nil
+}
@@ -0,0 +1,93 @@
+package modules
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/diceone/for-IT/internal/models"
+)
+
+func serveContent(t *testing.T, content string) (*httptest.Server, *int32) {
+	t.Helper()
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestGetURLChecksum(t *testing.T) {
+	srv, requests := serveContent(t, "release")
+	dest := filepath.Join(t.TempDir(), "app.tar.gz")
+	spec := &models.GetURLSpec{URL: srv.URL, Dest: dest, Checksum: "sha256:" + sha256Hex("release")}
+	h := &Host{Context: context.Background()}
+
+	result, err := runGetURL(h, spec)
+	if err != nil || !result.Changed {
+		t.Fatalf("first run: changed = %v, err = %v", result.Changed, err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "release" {
+		t.Fatalf("dest = %q, want %q", data, "release")
+	}
+
+	// A file with the expected checksum is not downloaded again
+	result, err = runGetURL(h, spec)
+	if err != nil || result.Changed {
+		t.Fatalf("second run: changed = %v, err = %v", result.Changed, err)
+	}
+	if n := atomic.LoadInt32(requests); n != 1 {
+		t.Errorf("requests = %d, want 1", n)
+	}
+}
+
+func TestGetURLChecksumMismatch(t *testing.T) {
+	srv, _ := serveContent(t, "tampered")
+	dest := filepath.Join(t.TempDir(), "app.tar.gz")
+	spec := &models.GetURLSpec{URL: srv.URL, Dest: dest, Checksum: sha256Hex("release")}
+
+	if _, err := runGetURL(&Host{Context: context.Background()}, spec); err == nil {
+		t.Fatal("expected a checksum error")
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Errorf("dest was created despite the checksum mismatch: %v", err)
+	}
+}
+
+func TestGetURLExistingWithoutChecksum(t *testing.T) {
+	srv, requests := serveContent(t, "new")
+	dest := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(dest, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := &Host{Context: context.Background()}
+
+	result, err := runGetURL(h, &models.GetURLSpec{URL: srv.URL, Dest: dest})
+	if err != nil || result.Changed {
+		t.Fatalf("changed = %v, err = %v", result.Changed, err)
+	}
+	if n := atomic.LoadInt32(requests); n != 0 {
+		t.Errorf("requests = %d, want 0", n)
+	}
+
+	result, err = runGetURL(h, &models.GetURLSpec{URL: srv.URL, Dest: dest, Force: true})
+	if err != nil || !result.Changed {
+		t.Fatalf("force: changed = %v, err = %v", result.Changed, err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "new" {
+		t.Errorf("dest = %q, want %q", data, "new")
+	}
+}
@@ -0,0 +1,256 @@
+package modules
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/diceone/for-IT/internal/diff"
+	"github.com/diceone/for-IT/internal/models"
+)
+
+// Positions accepted by insertafter and insertbefore besides a regular
+// expression.
+const (
+	endOfFile       = "EOF"
+	beginningOfFile = "BOF"
+)
+
+func validateLineInFile(spec *models.LineInFileSpec) error {
+	if err := validateEditPath(spec.Path); err != nil {
+		return err
+	}
+	if spec.Regexp != "" {
+		if _, err := regexp.Compile(spec.Regexp); err != nil {
+			return fmt.Errorf("regexp: %v", err)
+		}
+	}
+
+	switch spec.State {
+	case "", "present":
+		if spec.Line == "" {
+			return fmt.Errorf("line is required")
+		}
+		if strings.Contains(spec.Line, "\n") {
+			return fmt.Errorf("line must be a single line, use blockinfile for several lines")
+		}
+	case "absent":
+		if spec.Regexp == "" && spec.Line == "" {
+			return fmt.Errorf("regexp or line is required")
+		}
+	default:
+		return fmt.Errorf("state must be present or absent, not %q", spec.State)
+	}
+
+	return validateInsert(spec.InsertAfter, spec.InsertBefore)
+}
+
+func validateEditPath(path string) error {
+	if path == "" {
+		return fmt.Errorf("path is required")
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("path %q must be absolute", path)
+	}
+	return nil
+}
+
+func validateInsert(after, before string) error {
+	if after != "" && before != "" {
+		return fmt.Errorf("only one of insertafter and insertbefore may be given")
+	}
+	for _, pattern := range []string{after, before} {
+		if pattern != "" && pattern != endOfFile && pattern != beginningOfFile {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("insert position: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func runLineInFile(h *Host, spec *models.LineInFileSpec) (Result, error) {
+	return editFile(h, spec.Path, spec.Create, spec.Backup, func(lines []string) ([]string, string, error) {
+		// The patterns are checked again as variables may have changed them
+		var re *regexp.Regexp
+		if spec.Regexp != "" {
+			var err error
+			if re, err = regexp.Compile(spec.Regexp); err != nil {
+				return nil, "", fmt.Errorf("regexp: %v", err)
+			}
+		}
+		matches := func(line string) bool {
+			if re != nil {
+				return re.MatchString(line)
+			}
+			return line == spec.Line
+		}
+
+		if spec.State == "absent" {
+			kept := lines[:0:0]
+			for _, line := range lines {
+				if !matches(line) {
+					kept = append(kept, line)
+				}
+			}
+			switch removed := len(lines) - len(kept); removed {
+			case 0:
+				return lines, "", nil
+			case 1:
+				return kept, "removed 1 line", nil
+			default:
+				return kept, fmt.Sprintf("removed %d lines", removed), nil
+			}
+		}
+
+		// The last line matching regexp is replaced
+		if re != nil {
+			for i := len(lines) - 1; i >= 0; i-- {
+				if re.MatchString(lines[i]) {
+					if lines[i] == spec.Line {
+						return lines, "", nil
+					}
+					edited := append([]string(nil), lines...)
+					edited[i] = spec.Line
+					return edited, "replaced line", nil
+				}
+			}
+		}
+		for _, line := range lines {
+			if line == spec.Line {
+				return lines, "", nil
+			}
+		}
+
+		at, err := insertPosition(lines, spec.InsertAfter, spec.InsertBefore)
+		if err != nil {
+			return nil, "", err
+		}
+		return insertLines(lines, at, spec.Line), "added line", nil
+	})
+}
+
+// insertPosition returns the index at which new lines are inserted. The
+// last line matching after or before is used; without a match, or without a
+// position, lines go to the end of the file.
+func insertPosition(lines []string, after, before string) (int, error) {
+	switch {
+	case before == beginningOfFile || after == beginningOfFile:
+		return 0, nil
+	case before != "" && before != endOfFile:
+		re, err := regexp.Compile(before)
+		if err != nil {
+			return 0, fmt.Errorf("insertbefore: %v", err)
+		}
+		for i := len(lines) - 1; i >= 0; i-- {
+			if re.MatchString(lines[i]) {
+				return i, nil
+			}
+		}
+	case after != "" && after != endOfFile:
+		re, err := regexp.Compile(after)
+		if err != nil {
+			return 0, fmt.Errorf("insertafter: %v", err)
+		}
+		for i := len(lines) - 1; i >= 0; i-- {
+			if re.MatchString(lines[i]) {
+				return i + 1, nil
+			}
+		}
+	}
+	return len(lines), nil
+}
+
+func insertLines(lines []string, at int, insert ...string) []string {
+	edited := make([]string, 0, len(lines)+len(insert))
+	edited = append(edited, lines[:at]...)
+	edited = append(edited, insert...)
+	return append(edited, lines[at:]...)
+}
+
+// editFile applies edit to the lines of the file at path and writes the
+// result if it differs, keeping the file's mode and owner. edit returns the
+// new lines and a description of the change, which is empty if there is
+// none. A missing file is created empty if create is set.
+func editFile(h *Host, path string, create, backup bool, edit func(lines []string) ([]string, string, error)) (Result, error) {
+	var (
+		current []byte
+		mode    fs.FileMode = defaultFileMode
+		uid                 = -1
+		gid                 = -1
+		exists              = true
+	)
+	info, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err) && create:
+		exists = false
+	case os.IsNotExist(err):
+		return Result{}, fmt.Errorf("%s does not exist", path)
+	case err != nil:
+		return Result{}, err
+	case !info.Mode().IsRegular():
+		return Result{}, fmt.Errorf("%s is not a regular file", path)
+	default:
+		if current, err = os.ReadFile(path); err != nil {
+			return Result{}, err
+		}
+		mode = permBits(info.Mode())
+		uid, gid = fileOwner(info)
+	}
+
+	lines := splitLines(string(current))
+	edited, action, err := edit(lines)
+	if err != nil {
+		return Result{}, err
+	}
+	content := joinLines(edited)
+	if action == "" || content == string(current) {
+		return Result{Output: fmt.Sprintf("%s unchanged", path)}, nil
+	}
+
+	oldName := path
+	if !exists {
+		oldName = "/dev/null"
+		action = "created file, " + action
+	}
+	result := Result{
+		Changed: true,
+		Output:  fmt.Sprintf("%s: %s", path, action),
+		Diff:    diff.Unified(oldName, path, string(current), content),
+	}
+	if h.DryRun {
+		result.Output = "would have " + result.Output
+		return result, nil
+	}
+
+	if backup && exists {
+		backupPath := fmt.Sprintf("%s.%s~", path, time.Now().Format("2006-01-02@15:04:05"))
+		if err := writeFileAtomic(backupPath, current, mode, uid, gid); err != nil {
+			return Result{}, fmt.Errorf("failed to back up %s: %v", path, err)
+		}
+		result.Output += fmt.Sprintf(" (backup at %s)", backupPath)
+	}
+	if err := writeFileAtomic(path, []byte(content), mode, uid, gid); err != nil {
+		return Result{}, err
+	}
+	return result, nil
+}
+
+// splitLines splits content into lines without their line endings.
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+func joinLines(lines []string) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -0,0 +1,196 @@
+// Package modules implements the typed task modules, such as package:, that
+// manage a resource declaratively instead of running a shell command. A
+// module inspects the current state first and only reports a change when
+// it actually changed something.
+package modules
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/diceone/for-IT/internal/executor"
+	"github.com/diceone/for-IT/internal/models"
+)
+
+// Host gives modules access to the machine they manage.
+type Host struct {
+	// Context stops the programs a module runs when the task times out
+	Context  context.Context
+	Executor *executor.Executor
+	Facts    map[string]interface{}
+	// DryRun makes modules report what they would change without changing it
+	DryRun bool
+	// FetchFile returns a file hosted by the server from the given directory
+	// (e.g. files) of a role
+	FetchFile func(role, dir, path string) ([]byte, error)
+	// ModulesDir holds the external modules installed on the host
+	ModulesDir string
+	// StagingDir is where modules fetched from the server are written to
+	// before they run
+	StagingDir string
+}
+
+// Result is the outcome of a module run.
+type Result struct {
+	Changed bool
+	Output  string
+	// Diff is a unified diff of the content the module changed
+	Diff string
+	// Facts are facts an external module sets for the rest of the run
+	Facts map[string]interface{}
+}
+
+// Run runs the module of a task. ok is false if the task uses no module.
+func Run(host *Host, task models.Task) (result Result, ok bool, err error) {
+	switch {
+	case task.Package != nil:
+		result, err = runPackage(host, task.Package)
+	case task.Service != nil:
+		result, err = runService(host, task.Service)
+	case task.File != nil:
+		result, err = runFile(host, task.File, task.Role)
+	case task.Template != nil:
+		result, err = runTemplate(host, task)
+	case task.LineInFile != nil:
+		result, err = runLineInFile(host, task.LineInFile)
+	case task.BlockInFile != nil:
+		result, err = runBlockInFile(host, task.BlockInFile)
+	case task.User != nil:
+		result, err = runUser(host, task.User)
+	case task.Group != nil:
+		result, err = runGroup(host, task.Group)
+	case task.Cron != nil:
+		result, err = runCron(host, task.Cron)
+	case task.Sysctl != nil:
+		result, err = runSysctl(host, task.Sysctl)
+	case task.GetURL != nil:
+		result, err = runGetURL(host, task.GetURL)
+	case task.Unarchive != nil:
+		result, err = runUnarchive(host, task.Unarchive)
+	case task.Module != "":
+		result, err = runExternal(host, task)
+	default:
+		return Result{}, false, nil
+	}
+	return result, true, err
+}
+
+// Validate checks the module arguments of a task and that it uses exactly one
+// of command or a module.
+func Validate(task models.Task) error {
+	var used []string
+	if task.Command != "" {
+		used = append(used, "command")
+	}
+	if task.Package != nil {
+		used = append(used, "package")
+		if err := validatePackage(task.Package); err != nil {
+			return fmt.Errorf("package: %v", err)
+		}
+	}
+	if task.Service != nil {
+		used = append(used, "service")
+		if err := validateService(task.Service); err != nil {
+			return fmt.Errorf("service: %v", err)
+		}
+	}
+	if task.File != nil {
+		used = append(used, "file")
+		if err := validateFile(task.File, task.Role); err != nil {
+			return fmt.Errorf("file: %v", err)
+		}
+	}
+	if task.Template != nil {
+		used = append(used, "template")
+		if err := validateTemplate(task.Template, task.Role); err != nil {
+			return fmt.Errorf("template: %v", err)
+		}
+	}
+	if task.LineInFile != nil {
+		used = append(used, "lineinfile")
+		if err := validateLineInFile(task.LineInFile); err != nil {
+			return fmt.Errorf("lineinfile: %v", err)
+		}
+	}
+	if task.BlockInFile != nil {
+		used = append(used, "blockinfile")
+		if err := validateBlockInFile(task.BlockInFile); err != nil {
+			return fmt.Errorf("blockinfile: %v", err)
+		}
+	}
+	if task.User != nil {
+		used = append(used, "user")
+		if err := validateUser(task.User); err != nil {
+			return fmt.Errorf("user: %v", err)
+		}
+	}
+	if task.Group != nil {
+		used = append(used, "group")
+		if err := validateGroup(task.Group); err != nil {
+			return fmt.Errorf("group: %v", err)
+		}
+	}
+	if task.Cron != nil {
+		used = append(used, "cron")
+		if err := validateCron(task.Cron); err != nil {
+			return fmt.Errorf("cron: %v", err)
+		}
+	}
+	if task.Sysctl != nil {
+		used = append(used, "sysctl")
+		if err := validateSysctl(task.Sysctl); err != nil {
+			return fmt.Errorf("sysctl: %v", err)
+		}
+	}
+	if task.GetURL != nil {
+		used = append(used, "get_url")
+		if err := validateGetURL(task.GetURL); err != nil {
+			return fmt.Errorf("get_url: %v", err)
+		}
+	}
+	if task.Unarchive != nil {
+		used = append(used, "unarchive")
+		if err := validateUnarchive(task.Unarchive); err != nil {
+			return fmt.Errorf("unarchive: %v", err)
+		}
+	}
+	if task.Module != "" {
+		used = append(used, "module")
+		if err := validateExternal(task.Module); err != nil {
+			return fmt.Errorf("module: %v", err)
+		}
+	} else if task.Args != nil {
+		return fmt.Errorf("args is only allowed with module")
+	}
+
+	switch len(used) {
+	case 0:
+		return fmt.Errorf("no command or module given")
+	case 1:
+		return nil
+	}
+	return fmt.Errorf("only one of %s may be given", strings.Join(used, ", "))
+}
+
+// run runs a program and fails if it exits with a non-zero code.
+func (h *Host) run(env map[string]string, name string, args ...string) (executor.Output, error) {
+	out, err := h.Executor.RunArgs(h.Context, env, name, args...)
+	if err != nil {
+		return out, err
+	}
+	if out.ExitCode != 0 {
+		msg := out.Stderr
+		if msg == "" {
+			msg = out.Stdout
+		}
+		return out, fmt.Errorf("%s %s exited with code %d: %s", name, strings.Join(args, " "), out.ExitCode, msg)
+	}
+	return out, nil
+}
+
+// fact returns a string fact of the host.
+func (h *Host) fact(name string) string {
+	value, _ := h.Facts[name].(string)
+	return value
+}
@@ -0,0 +1,480 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/diceone/for-IT/internal/models"
+)
+
+// packageManager is a backend of the package module. Every method handles
+// all given packages in a single call of the underlying tool.
+type packageManager interface {
+	// installed returns the installed version of each given package that is
+	// installed.
+	installed(h *Host, names []string) (map[string]string, error)
+	// outdated returns the installed packages among names for which a newer
+	// version is available.
+	outdated(h *Host, names []string) (map[string]bool, error)
+	updateCache(h *Host) error
+	install(h *Host, packages []string) error
+	upgrade(h *Host, names []string) error
+	remove(h *Host, names []string) error
+	// versioned returns the argument that installs a specific version.
+	versioned(name, version string) (string, error)
+}
+
+var packageManagers = map[string]packageManager{
+	"apt":    aptManager{},
+	"dnf":    rpmManager{binary: "dnf"},
+	"yum":    rpmManager{binary: "yum"},
+	"zypper": zypperManager{},
+	"pacman": pacmanManager{},
+}
+
+func validatePackage(spec *models.PackageSpec) error {
+	if len(spec.Name) == 0 {
+		return fmt.Errorf("name is required")
+	}
+	for _, name := range spec.Name {
+		if name == "" || strings.HasPrefix(name, "-") {
+			return fmt.Errorf("invalid package name %q", name)
+		}
+	}
+
+	switch spec.State {
+	case "", "present", "absent", "latest":
+	default:
+		return fmt.Errorf("state must be present, absent or latest, not %q", spec.State)
+	}
+
+	if spec.Version != "" && (len(spec.Name) != 1 || (spec.State != "" && spec.State != "present")) {
+		return fmt.Errorf("version requires a single package and state present")
+	}
+
+	if _, ok := packageManagers[spec.Use]; spec.Use != "" && !ok {
+		return fmt.Errorf("unsupported package manager %q", spec.Use)
+	}
+	return nil
+}
+
+func runPackage(h *Host, spec *models.PackageSpec) (Result, error) {
+	managerName := spec.Use
+	if managerName == "" {
+		managerName = h.fact("package_manager")
+	}
+	pm, ok := packageManagers[managerName]
+	if !ok {
+		return Result{}, fmt.Errorf("no supported package manager found (package_manager fact: %q)", managerName)
+	}
+
+	state := spec.State
+	if state == "" {
+		state = "present"
+	}
+	names := []string(spec.Name)
+
+	if spec.UpdateCache && state != "absent" && !h.DryRun {
+		if err := pm.updateCache(h); err != nil {
+			return Result{}, fmt.Errorf("failed to update package cache: %v", err)
+		}
+	}
+
+	installed, err := pm.installed(h, names)
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to query installed packages: %v", err)
+	}
+
+	var toInstall, toUpgrade, toRemove []string
+	switch state {
+	case "present":
+		for _, name := range names {
+			current, ok := installed[name]
+			switch {
+			case spec.Version != "" && (!ok || !versionMatches(current, spec.Version)):
+				arg, err := pm.versioned(name, spec.Version)
+				if err != nil {
+					return Result{}, err
+				}
+				toInstall = append(toInstall, arg)
+			case !ok:
+				toInstall = append(toInstall, name)
+			}
+		}
+
+	case "latest":
+		var present []string
+		for _, name := range names {
+			if _, ok := installed[name]; ok {
+				present = append(present, name)
+			} else {
+				toInstall = append(toInstall, name)
+			}
+		}
+		if len(present) > 0 {
+			outdated, err := pm.outdated(h, present)
+			if err != nil {
+				return Result{}, fmt.Errorf("failed to query available updates: %v", err)
+			}
+			for _, name := range present {
+				if outdated[name] {
+					toUpgrade = append(toUpgrade, name)
+				}
+			}
+		}
+
+	case "absent":
+		for _, name := range names {
+			if _, ok := installed[name]; ok {
+				toRemove = append(toRemove, name)
+			}
+		}
+	}
+
+	if len(toInstall) == 0 && len(toUpgrade) == 0 && len(toRemove) == 0 {
+		return Result{Output: fmt.Sprintf("%s already %s", strings.Join(names, ", "), state)}, nil
+	}
+
+	prefix := ""
+	if h.DryRun {
+		prefix = "would have "
+	} else {
+		if len(toInstall) > 0 {
+			if err := pm.install(h, toInstall); err != nil {
+				return Result{}, err
+			}
+		}
+		if len(toUpgrade) > 0 {
+			if err := pm.upgrade(h, toUpgrade); err != nil {
+				return Result{}, err
+			}
+		}
+		if len(toRemove) > 0 {
+			if err := pm.remove(h, toRemove); err != nil {
+				return Result{}, err
+			}
+		}
+	}
+
+	var summary []string
+	for _, part := range []struct {
+		verb     string
+		packages []string
+	}{{"installed", toInstall}, {"upgraded", toUpgrade}, {"removed", toRemove}} {
+		if len(part.packages) > 0 {
+			summary = append(summary, fmt.Sprintf("%s%s %s", prefix, part.verb, strings.Join(part.packages, ", ")))
+		}
+	}
+	return Result{Changed: true, Output: strings.Join(summary, "; ")}, nil
+}
+
+// versionMatches reports whether an installed version satisfies the
+// requested one. The request may be a prefix ending at a segment boundary,
+// so 10.11 matches 1:10.11.6-0+deb12u1.
+func versionMatches(installed, requested string) bool {
+	if i := strings.Index(installed, ":"); i >= 0 {
+		installed = installed[i+1:]
+	}
+	if installed == requested {
+		return true
+	}
+	return strings.HasPrefix(installed, requested) && strings.ContainsAny(installed[len(requested):len(requested)+1], ".-+~")
+}
+
+// aptManager manages packages on Debian and Ubuntu. Installs keep existing
+// configuration files and never prompt.
+type aptManager struct{}
+
+var aptEnv = map[string]string{
+	"DEBIAN_FRONTEND":          "noninteractive",
+	"APT_LISTCHANGES_FRONTEND": "none",
+}
+
+var aptInstallArgs = []string{"install", "-y", "-q", "-o", "Dpkg::Options::=--force-confdef", "-o", "Dpkg::Options::=--force-confold"}
+
+func (aptManager) installed(h *Host, names []string) (map[string]string, error) {
+	args := append([]string{"-W", "-f=${Package}\\t${Status}\\t${Version}\\n"}, names...)
+	// dpkg-query exits 1 if some packages are unknown, so only the output counts
+	out, err := h.Executor.RunArgs(h.Context, nil, "dpkg-query", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	installed := make(map[string]string)
+	for _, line := range strings.Split(out.Stdout, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) == 3 && strings.HasSuffix(fields[1], " installed") {
+			installed[fields[0]] = fields[2]
+		}
+	}
+	return installed, nil
+}
+
+func (aptManager) outdated(h *Host, names []string) (map[string]bool, error) {
+	out, err := h.run(nil, "apt-cache", append([]string{"policy"}, names...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	outdated := make(map[string]bool)
+	var name, current string
+	for _, line := range strings.Split(out.Stdout, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case !strings.HasPrefix(line, " ") && strings.HasSuffix(line, ":"):
+			name, current = strings.TrimSuffix(line, ":"), ""
+		case strings.HasPrefix(trimmed, "Installed:"):
+			current = strings.TrimSpace(strings.TrimPrefix(trimmed, "Installed:"))
+		case strings.HasPrefix(trimmed, "Candidate:"):
+			candidate := strings.TrimSpace(strings.TrimPrefix(trimmed, "Candidate:"))
+			if current != "" && current != "(none)" && candidate != "(none)" && candidate != current {
+				outdated[name] = true
+			}
+		}
+	}
+	return outdated, nil
+}
+
+func (aptManager) updateCache(h *Host) error {
+	_, err := h.run(aptEnv, "apt-get", "update", "-q")
+	return err
+}
+
+func (aptManager) install(h *Host, packages []string) error {
+	_, err := h.run(aptEnv, "apt-get", append(aptInstallArgs, packages...)...)
+	return err
+}
+
+func (aptManager) upgrade(h *Host, names []string) error {
+	args := append(append([]string{}, aptInstallArgs...), "--only-upgrade")
+	_, err := h.run(aptEnv, "apt-get", append(args, names...)...)
+	return err
+}
+
+func (aptManager) remove(h *Host, names []string) error {
+	_, err := h.run(aptEnv, "apt-get", append([]string{"remove", "-y", "-q"}, names...)...)
+	return err
+}
+
+func (aptManager) versioned(name, version string) (string, error) {
+	return name + "=" + version, nil
+}
+
+// rpmInstalled queries the rpm database, which dnf, yum and zypper share.
+// Names that are not package names are looked up as capabilities that an
+// installed package provides.
+func rpmInstalled(h *Host, names []string) (map[string]string, error) {
+	args := append([]string{"-q", "--qf", "%{NAME}\\t%{VERSION}-%{RELEASE}\\n"}, names...)
+	// rpm -q exits with the number of packages that are not installed
+	out, err := h.Executor.RunArgs(h.Context, nil, "rpm", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	installed := make(map[string]string)
+	for _, line := range strings.Split(out.Stdout, "\n") {
+		if name, version, ok := strings.Cut(line, "\t"); ok {
+			installed[name] = version
+		}
+	}
+
+	// Names such as vim are often provided by a package of another name,
+	// vim-enhanced, that dnf and yum install for them
+	for _, name := range names {
+		if _, ok := installed[name]; ok {
+			continue
+		}
+		out, err := h.Executor.RunArgs(h.Context, nil, "rpm", "-q", "--whatprovides", "--qf", "%{VERSION}-%{RELEASE}\\n", name)
+		if err != nil {
+			return nil, err
+		}
+		if out.ExitCode == 0 {
+			version, _, _ := strings.Cut(out.Stdout, "\n")
+			installed[name] = version
+		}
+	}
+	return installed, nil
+}
+
+// rpmManager manages packages with dnf or yum.
+type rpmManager struct {
+	binary string
+}
+
+func (rpmManager) installed(h *Host, names []string) (map[string]string, error) {
+	return rpmInstalled(h, names)
+}
+
+func (m rpmManager) outdated(h *Host, names []string) (map[string]bool, error) {
+	out, err := h.Executor.RunArgs(h.Context, nil, m.binary, append([]string{"check-update", "-q"}, names...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	outdated := make(map[string]bool)
+	switch out.ExitCode {
+	case 0:
+		return outdated, nil
+	case 100: // updates available
+	default:
+		return nil, fmt.Errorf("%s check-update exited with code %d: %s", m.binary, out.ExitCode, out.Stderr)
+	}
+
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	for _, line := range strings.Split(out.Stdout, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		// The first column is name.arch
+		name := fields[0]
+		if i := strings.LastIndex(name, "."); i > 0 {
+			name = name[:i]
+		}
+		if wanted[name] {
+			outdated[name] = true
+		}
+	}
+	return outdated, nil
+}
+
+func (m rpmManager) updateCache(h *Host) error {
+	_, err := h.run(nil, m.binary, "makecache", "-q")
+	return err
+}
+
+func (m rpmManager) install(h *Host, packages []string) error {
+	_, err := h.run(nil, m.binary, append([]string{"install", "-y", "-q"}, packages...)...)
+	return err
+}
+
+func (m rpmManager) upgrade(h *Host, names []string) error {
+	_, err := h.run(nil, m.binary, append([]string{"upgrade", "-y", "-q"}, names...)...)
+	return err
+}
+
+func (m rpmManager) remove(h *Host, names []string) error {
+	_, err := h.run(nil, m.binary, append([]string{"remove", "-y", "-q"}, names...)...)
+	return err
+}
+
+func (rpmManager) versioned(name, version string) (string, error) {
+	return name + "-" + version, nil
+}
+
+// zypperManager manages packages on SUSE.
+type zypperManager struct{}
+
+func (zypperManager) installed(h *Host, names []string) (map[string]string, error) {
+	return rpmInstalled(h, names)
+}
+
+func (zypperManager) outdated(h *Host, names []string) (map[string]bool, error) {
+	out, err := h.run(nil, "zypper", "--non-interactive", "--quiet", "list-updates")
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	// Rows look like: v | Repository | Name | Current Version | Available Version | Arch
+	outdated := make(map[string]bool)
+	for _, line := range strings.Split(out.Stdout, "\n") {
+		columns := strings.Split(line, "|")
+		if len(columns) >= 3 {
+			if name := strings.TrimSpace(columns[2]); wanted[name] {
+				outdated[name] = true
+			}
+		}
+	}
+	return outdated, nil
+}
+
+func (zypperManager) updateCache(h *Host) error {
+	_, err := h.run(nil, "zypper", "--non-interactive", "refresh")
+	return err
+}
+
+func (zypperManager) install(h *Host, packages []string) error {
+	_, err := h.run(nil, "zypper", append([]string{"--non-interactive", "install"}, packages...)...)
+	return err
+}
+
+func (zypperManager) upgrade(h *Host, names []string) error {
+	_, err := h.run(nil, "zypper", append([]string{"--non-interactive", "update"}, names...)...)
+	return err
+}
+
+func (zypperManager) remove(h *Host, names []string) error {
+	_, err := h.run(nil, "zypper", append([]string{"--non-interactive", "remove"}, names...)...)
+	return err
+}
+
+func (zypperManager) versioned(name, version string) (string, error) {
+	return name + "=" + version, nil
+}
+
+// pacmanManager manages packages on Arch Linux.
+type pacmanManager struct{}
+
+func (pacmanManager) installed(h *Host, names []string) (map[string]string, error) {
+	// pacman -Q exits 1 if some packages are not installed
+	out, err := h.Executor.RunArgs(h.Context, nil, "pacman", append([]string{"-Q"}, names...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	installed := make(map[string]string)
+	for _, line := range strings.Split(out.Stdout, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			installed[fields[0]] = fields[1]
+		}
+	}
+	return installed, nil
+}
+
+func (pacmanManager) outdated(h *Host, names []string) (map[string]bool, error) {
+	// pacman -Qu exits 1 if nothing is outdated; lines read "name old -> new"
+	out, err := h.Executor.RunArgs(h.Context, nil, "pacman", append([]string{"-Qu"}, names...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	outdated := make(map[string]bool)
+	for _, line := range strings.Split(out.Stdout, "\n") {
+		if fields := strings.Fields(line); len(fields) >= 4 {
+			outdated[fields[0]] = true
+		}
+	}
+	return outdated, nil
+}
+
+func (pacmanManager) updateCache(h *Host) error {
+	_, err := h.run(nil, "pacman", "-Sy", "--noconfirm")
+	return err
+}
+
+func (pacmanManager) install(h *Host, packages []string) error {
+	_, err := h.run(nil, "pacman", append([]string{"-S", "--noconfirm", "--needed"}, packages...)...)
+	return err
+}
+
+func (pacmanManager) upgrade(h *Host, names []string) error {
+	_, err := h.run(nil, "pacman", append([]string{"-S", "--noconfirm"}, names...)...)
+	return err
+}
+
+func (pacmanManager) remove(h *Host, names []string) error {
+	_, err := h.run(nil, "pacman", append([]string{"-R", "--noconfirm"}, names...)...)
+	return err
+}
+
+func (pacmanManager) versioned(name, version string) (string, error) {
+	return "", fmt.Errorf("pacman cannot install a specific version of %s", name)
+}
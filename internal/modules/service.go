@@ -0,0 +1,155 @@
+package modules
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/diceone/for-IT/internal/models"
+)
+
+func validateService(spec *models.ServiceSpec) error {
+	if spec.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if strings.HasPrefix(spec.Name, "-") {
+		return fmt.Errorf("invalid unit name %q", spec.Name)
+	}
+
+	switch spec.State {
+	case "", "started", "stopped", "restarted", "reloaded":
+	default:
+		return fmt.Errorf("state must be started, stopped, restarted or reloaded, not %q", spec.State)
+	}
+
+	if spec.State == "" && spec.Enabled == nil && !spec.DaemonReload {
+		return fmt.Errorf("one of state, enabled or daemon_reload is required")
+	}
+	return nil
+}
+
+// runService brings a systemd unit into the requested state. started,
+// stopped and enabled only act if the unit is not in that state already;
+// restarted and reloaded always act and so always report a change.
+// daemon_reload does not change the unit itself and is not reported as one.
+func runService(h *Host, spec *models.ServiceSpec) (Result, error) {
+	if spec.DaemonReload && !h.DryRun {
+		if _, err := h.run(nil, "systemctl", "daemon-reload"); err != nil {
+			return Result{}, err
+		}
+	}
+	if spec.State == "" && spec.Enabled == nil {
+		return Result{Output: "reloaded systemd configuration"}, nil
+	}
+
+	out, err := h.run(nil, "systemctl", "show", "--property=LoadState", "--value", spec.Name)
+	if err != nil {
+		return Result{}, err
+	}
+	if out.Stdout == "not-found" {
+		return Result{}, fmt.Errorf("unit %s not found", spec.Name)
+	}
+	masked := out.Stdout == "masked"
+
+	var actions []string
+	if spec.Enabled != nil {
+		action, err := serviceEnabled(h, spec.Name, *spec.Enabled, masked)
+		if err != nil {
+			return Result{}, err
+		}
+		if action != "" {
+			actions = append(actions, action)
+		}
+	}
+	if spec.State != "" {
+		action, err := serviceState(h, spec.Name, spec.State)
+		if err != nil {
+			return Result{}, err
+		}
+		if action != "" {
+			actions = append(actions, action)
+		}
+	}
+
+	if len(actions) == 0 {
+		var state []string
+		if spec.State != "" {
+			state = append(state, spec.State)
+		}
+		if spec.Enabled != nil {
+			state = append(state, map[bool]string{true: "enabled", false: "disabled"}[*spec.Enabled])
+		}
+		return Result{Output: fmt.Sprintf("%s already %s", spec.Name, strings.Join(state, " and "))}, nil
+	}
+
+	prefix := ""
+	if h.DryRun {
+		prefix = "would have "
+	}
+	return Result{Changed: true, Output: fmt.Sprintf("%s%s %s", prefix, strings.Join(actions, " and "), spec.Name)}, nil
+}
+
+// serviceEnabled enables or disables a unit if needed and returns what it
+// did. Units without an [Install] section (static, indirect, ...) can be
+// neither enabled nor disabled and are left alone.
+func serviceEnabled(h *Host, name string, enabled, masked bool) (string, error) {
+	out, err := h.Executor.RunArgs(h.Context, nil, "systemctl", "is-enabled", name)
+	if err != nil {
+		return "", err
+	}
+	current := out.Stdout
+
+	switch {
+	case enabled && masked:
+		return "", fmt.Errorf("unit %s is masked and cannot be enabled", name)
+	case enabled && out.ExitCode != 0:
+		if !h.DryRun {
+			if _, err := h.run(nil, "systemctl", "enable", name); err != nil {
+				return "", err
+			}
+		}
+		return "enabled", nil
+	case !enabled && (current == "enabled" || current == "enabled-runtime"):
+		if !h.DryRun {
+			if _, err := h.run(nil, "systemctl", "disable", name); err != nil {
+				return "", err
+			}
+		}
+		return "disabled", nil
+	}
+	return "", nil
+}
+
+// serviceState starts, stops, restarts or reloads a unit if needed and
+// returns what it did.
+func serviceState(h *Host, name, state string) (string, error) {
+	out, err := h.Executor.RunArgs(h.Context, nil, "systemctl", "is-active", name)
+	if err != nil {
+		return "", err
+	}
+	// activating and reloading units are on their way to being active
+	active := out.Stdout == "active" || out.Stdout == "activating" || out.Stdout == "reloading"
+
+	var verb, action string
+	switch {
+	case state == "started" && !active:
+		verb, action = "start", "started"
+	case state == "stopped" && active:
+		verb, action = "stop", "stopped"
+	case state == "restarted":
+		verb, action = "restart", "restarted"
+	case state == "reloaded" && active:
+		verb, action = "reload", "reloaded"
+	case state == "reloaded":
+		// A unit that is not running is started instead of reloaded
+		verb, action = "start", "started"
+	default:
+		return "", nil
+	}
+
+	if !h.DryRun {
+		if _, err := h.run(nil, "systemctl", verb, name); err != nil {
+			return "", err
+		}
+	}
+	return action, nil
+}
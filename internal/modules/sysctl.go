@@ -0,0 +1,149 @@
+package modules
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/diceone/for-IT/internal/models"
+)
+
+// The runtime and persistent locations of kernel parameters.
+var (
+	procSysDir = "/proc/sys"
+	sysctlDir  = "/etc/sysctl.d"
+)
+
+const defaultSysctlFile = "99-for.conf"
+
+var sysctlName = regexp.MustCompile(`^[A-Za-z0-9_-]+([./][A-Za-z0-9_:@-]+)*$`)
+
+func validateSysctl(spec *models.SysctlSpec) error {
+	if !sysctlName.MatchString(spec.Name) {
+		return fmt.Errorf("invalid parameter name %q", spec.Name)
+	}
+	switch spec.State {
+	case "", "present":
+		if spec.Value == "" || strings.Contains(spec.Value, "\n") {
+			return fmt.Errorf("value is required and must be a single line")
+		}
+	case "absent":
+	default:
+		return fmt.Errorf("state must be present or absent, not %q", spec.State)
+	}
+	if spec.File != "" && (strings.ContainsAny(spec.File, `/\`) || !strings.HasSuffix(spec.File, ".conf")) {
+		return fmt.Errorf("file must be a file name ending in .conf")
+	}
+	return nil
+}
+
+// runSysctl sets a kernel parameter at runtime through /proc/sys and keeps
+// it in a file below /etc/sysctl.d so it survives a reboot. state absent
+// only removes the persistent setting; the running value is left alone.
+func runSysctl(h *Host, spec *models.SysctlSpec) (Result, error) {
+	file := spec.File
+	if file == "" {
+		file = defaultSysctlFile
+	}
+	path := filepath.Join(sysctlDir, file)
+
+	if spec.State == "absent" {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return Result{Output: fmt.Sprintf("%s unchanged", path)}, nil
+		}
+		return editFile(h, path, false, false, editSysctl(spec))
+	}
+
+	var actions []string
+	procPath := filepath.Join(procSysDir, sysctlPath(spec.Name))
+	data, err := os.ReadFile(procPath)
+	if os.IsNotExist(err) {
+		return Result{}, fmt.Errorf("unknown kernel parameter %s", spec.Name)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	current := normalizeSysctl(string(data))
+	value := normalizeSysctl(spec.Value)
+	if current != value {
+		actions = append(actions, fmt.Sprintf("set %s = %s (was %s)", spec.Name, value, current))
+		if !h.DryRun {
+			if err := os.WriteFile(procPath, []byte(value+"\n"), 0644); err != nil {
+				return Result{}, fmt.Errorf("failed to set %s: %v", spec.Name, err)
+			}
+		}
+	}
+
+	persist, err := editFile(h, path, true, false, editSysctl(spec))
+	if err != nil {
+		return Result{}, err
+	}
+	if persist.Changed {
+		actions = append(actions, strings.TrimPrefix(persist.Output, "would have "))
+	}
+
+	if len(actions) == 0 {
+		return Result{Output: fmt.Sprintf("%s already %s", spec.Name, value)}, nil
+	}
+	output := strings.Join(actions, "; ")
+	if h.DryRun {
+		output = "would have " + output
+	}
+	return Result{Changed: true, Output: output, Diff: persist.Diff}, nil
+}
+
+// sysctlPath converts a parameter name to its path below /proc/sys. Dots
+// separate the components; a slash stands for a dot within a component,
+// such as in a VLAN interface name.
+func sysctlPath(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.':
+			return '/'
+		case '/':
+			return '.'
+		}
+		return r
+	}, name)
+}
+
+// normalizeSysctl collapses the whitespace between the fields of values such
+// as net.ipv4.tcp_rmem, which the kernel separates with tabs.
+func normalizeSysctl(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// editSysctl sets or removes the setting of a parameter in a sysctl.d file.
+func editSysctl(spec *models.SysctlSpec) func(lines []string) ([]string, string, error) {
+	return func(lines []string) ([]string, string, error) {
+		line := fmt.Sprintf("%s = %s", spec.Name, normalizeSysctl(spec.Value))
+		var (
+			edited []string
+			found  bool
+		)
+		for _, l := range lines {
+			key, _, ok := strings.Cut(l, "=")
+			if !ok || strings.TrimPrefix(strings.TrimSpace(key), "-") != spec.Name {
+				edited = append(edited, l)
+				continue
+			}
+			// Keep a single setting of the parameter
+			if spec.State != "absent" && !found {
+				edited = append(edited, line)
+			}
+			found = true
+		}
+
+		switch {
+		case spec.State == "absent" && found:
+			return edited, "removed " + spec.Name, nil
+		case spec.State == "absent":
+			return lines, "", nil
+		case !found:
+			edited = append(edited, line)
+		}
+		return edited, "persisted " + spec.Name, nil
+	}
+}
@@ -0,0 +1,57 @@
+package modules
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/diceone/for-IT/internal/models"
+	"github.com/diceone/for-IT/internal/templates"
+)
+
+func validateTemplate(spec *models.TemplateSpec, role string) error {
+	if spec.Source == "" {
+		return fmt.Errorf("source is required")
+	}
+	if role == "" {
+		return fmt.Errorf("templates are only available to tasks of a role")
+	}
+	return validateFile(&models.FileSpec{
+		Path:  spec.Path,
+		Owner: spec.Owner,
+		Group: spec.Group,
+		Mode:  spec.Mode,
+	}, role)
+}
+
+// runTemplate renders a template of the task's role on the host, where the
+// facts are current, and writes the result like a file task.
+func runTemplate(h *Host, task models.Task) (Result, error) {
+	spec := task.Template
+	if h.FetchFile == nil {
+		return Result{}, fmt.Errorf("no server to fetch templates from")
+	}
+	text, err := h.FetchFile(task.Role, "templates", spec.Source)
+	if err != nil {
+		return Result{}, fmt.Errorf("source %s: %v", spec.Source, err)
+	}
+
+	data := make(map[string]interface{}, len(task.Vars)+2)
+	for name, value := range task.Vars {
+		data[name] = value
+	}
+	data["hostname"] = h.fact("hostname")
+	data["facts"] = h.Facts
+
+	content, err := templates.Render(path.Join(task.Role, "templates", spec.Source), string(text), data)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return runFile(h, &models.FileSpec{
+		Path:    spec.Path,
+		Owner:   spec.Owner,
+		Group:   spec.Group,
+		Mode:    spec.Mode,
+		Content: &content,
+	}, task.Role)
+}
@@ -0,0 +1,439 @@
+package modules
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/diceone/for-IT/internal/models"
+	"github.com/ulikunitz/xz"
+)
+
+var archiveSuffixes = []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz", ".zip"}
+
+func validateUnarchive(spec *models.UnarchiveSpec) error {
+	if err := validateEditPath(spec.Source); err != nil {
+		return fmt.Errorf("source: %v", err)
+	}
+	if archiveFormat(spec.Source) == "" {
+		return fmt.Errorf("source must be one of %s", strings.Join(archiveSuffixes, ", "))
+	}
+	if err := validateEditPath(spec.Dest); err != nil {
+		return fmt.Errorf("dest: %v", err)
+	}
+	if spec.Creates != "" && !filepath.IsAbs(spec.Creates) {
+		return fmt.Errorf("creates must be an absolute path")
+	}
+	if spec.StripComponents < 0 {
+		return fmt.Errorf("strip_components must not be negative")
+	}
+	return nil
+}
+
+// archiveFormat returns the suffix of one of the supported archive formats
+// that path ends with, or "".
+func archiveFormat(path string) string {
+	format := ""
+	for _, suffix := range archiveSuffixes {
+		if strings.HasSuffix(strings.ToLower(path), suffix) && len(suffix) > len(format) {
+			format = suffix
+		}
+	}
+	return format
+}
+
+// archiveEntry is a file, directory or link read from an archive.
+type archiveEntry struct {
+	name     string
+	mode     fs.FileMode
+	linkname string
+	hardlink bool
+	open     func() (io.ReadCloser, error)
+}
+
+// runUnarchive extracts an archive into a directory. The archive is read
+// twice: once to compare its entries with the files below dest, and only if
+// something differs once more to extract it.
+func runUnarchive(h *Host, spec *models.UnarchiveSpec) (Result, error) {
+	if spec.Creates != "" {
+		if _, err := os.Lstat(spec.Creates); err == nil {
+			return Result{Output: fmt.Sprintf("%s exists", spec.Creates)}, nil
+		}
+	}
+	info, err := os.Stat(spec.Dest)
+	if err != nil {
+		return Result{}, fmt.Errorf("dest: %v", err)
+	}
+	if !info.IsDir() {
+		return Result{}, fmt.Errorf("dest %s is not a directory", spec.Dest)
+	}
+
+	uid, gid := -1, -1
+	if spec.Owner != "" {
+		if uid, err = lookupUser(spec.Owner); err != nil {
+			return Result{}, err
+		}
+	}
+	if spec.Group != "" {
+		if gid, err = lookupGroup(spec.Group); err != nil {
+			return Result{}, err
+		}
+	}
+
+	var changed, entries int
+	err = walkArchive(spec.Source, func(e *archiveEntry) error {
+		target, err := entryPath(spec, e.name)
+		if err != nil || target == "" {
+			return err
+		}
+		differs, err := entryDiffers(e, target, uid, gid)
+		if err != nil {
+			return err
+		}
+		entries++
+		if differs {
+			changed++
+		}
+		return nil
+	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	if changed == 0 {
+		return Result{Output: fmt.Sprintf("%s already extracted to %s", spec.Source, spec.Dest)}, nil
+	}
+	output := fmt.Sprintf("extracted %s to %s (%d of %d entries changed)", spec.Source, spec.Dest, changed, entries)
+	if h.DryRun {
+		return Result{Changed: true, Output: "would have " + output}, nil
+	}
+
+	err = walkArchive(spec.Source, func(e *archiveEntry) error {
+		target, err := entryPath(spec, e.name)
+		if err != nil || target == "" {
+			return err
+		}
+		return extractEntry(spec, e, target, uid, gid)
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Changed: true, Output: output}, nil
+}
+
+// entryPath returns the path below dest an entry is extracted to, or "" if
+// stripping components leaves nothing of its name. Names that would escape
+// dest are rejected.
+func entryPath(spec *models.UnarchiveSpec, name string) (string, error) {
+	clean := path.Clean(strings.ReplaceAll(name, `\`, "/"))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%s: entry %q is outside of the archive", spec.Source, name)
+	}
+	parts := strings.Split(clean, "/")
+	if clean == "." || len(parts) <= spec.StripComponents {
+		return "", nil
+	}
+	return filepath.Join(spec.Dest, filepath.FromSlash(strings.Join(parts[spec.StripComponents:], "/"))), nil
+}
+
+// checkInside makes sure that the directory target is extracted into does not
+// lead out of dest through a symlink, which an earlier entry might have
+// created. Directories that do not exist yet are checked through their
+// nearest existing parent.
+func checkInside(dest, target string) error {
+	root, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(target)
+	for {
+		if _, err := os.Lstat(dir); err == nil || dir == dest || len(dir) <= len(dest) {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(root, dir); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside of %s", target, dest)
+	}
+	return nil
+}
+
+// entryDiffers reports whether extracting an entry would change target.
+func entryDiffers(e *archiveEntry, target string, uid, gid int) (bool, error) {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	currentUID, currentGID := fileOwner(info)
+	if (uid != -1 && uid != currentUID) || (gid != -1 && gid != currentGID) {
+		return true, nil
+	}
+
+	switch {
+	case e.mode.IsDir():
+		return !info.IsDir() || permBits(info.Mode()) != permBits(e.mode), nil
+	case e.mode&fs.ModeSymlink != 0:
+		if info.Mode()&fs.ModeSymlink == 0 {
+			return true, nil
+		}
+		current, err := os.Readlink(target)
+		return err != nil || current != e.linkname, nil
+	case e.hardlink:
+		// Hard links are compared through the file they link to
+		return !info.Mode().IsRegular(), nil
+	}
+
+	if !info.Mode().IsRegular() || permBits(info.Mode()) != permBits(e.mode) {
+		return true, nil
+	}
+	r, err := e.open()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	f, err := os.Open(target)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	return !sameContent(r, f), nil
+}
+
+// sameContent compares two readers chunk by chunk.
+func sameContent(a, b io.Reader) bool {
+	bufA, bufB := make([]byte, 32*1024), make([]byte, 32*1024)
+	for {
+		n, errA := io.ReadFull(a, bufA)
+		m, errB := io.ReadFull(b, bufB)
+		if !bytes.Equal(bufA[:n], bufB[:m]) {
+			return false
+		}
+		doneA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		doneB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if doneA || doneB || errA != nil || errB != nil {
+			return doneA && doneB
+		}
+	}
+}
+
+func extractEntry(spec *models.UnarchiveSpec, e *archiveEntry, target string, uid, gid int) error {
+	if err := checkInside(spec.Dest, target); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	switch {
+	case e.mode.IsDir():
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
+		if err := os.Mkdir(target, permBits(e.mode)); err != nil && !os.IsExist(err) {
+			return err
+		}
+		if err := os.Chmod(target, permBits(e.mode)); err != nil {
+			return err
+		}
+	case e.mode&fs.ModeSymlink != 0:
+		if err := removeForReplace(target); err != nil {
+			return err
+		}
+		if err := os.Symlink(e.linkname, target); err != nil {
+			return err
+		}
+	case e.hardlink:
+		source, err := entryPath(spec, e.linkname)
+		if err != nil {
+			return err
+		}
+		if source == "" {
+			return fmt.Errorf("%s: hard link %q points outside of the extracted files", spec.Source, e.name)
+		}
+		if err := checkInside(spec.Dest, source); err != nil {
+			return err
+		}
+		if err := removeForReplace(target); err != nil {
+			return err
+		}
+		if err := os.Link(source, target); err != nil {
+			return err
+		}
+	default:
+		r, err := e.open()
+		if err != nil {
+			return err
+		}
+		err = writeFromReader(target, r, permBits(e.mode))
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if uid != -1 || gid != -1 {
+		return os.Lchown(target, uid, gid)
+	}
+	return nil
+}
+
+// removeForReplace removes target so a link can be created in its place.
+// Directories are left alone and make creating the link fail.
+func removeForReplace(target string) error {
+	info, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", target)
+	}
+	return os.Remove(target)
+}
+
+// writeFromReader replaces target with the content of r through a temporary
+// file, like writeFileAtomic.
+func writeFromReader(target string, r io.Reader, mode fs.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".for-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(target); err == nil && info.IsDir() {
+		return fmt.Errorf("%s is a directory", target)
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// walkArchive calls fn for every entry of an archive in the order they are
+// stored.
+func walkArchive(source string, fn func(*archiveEntry) error) error {
+	if archiveFormat(source) == ".zip" {
+		return walkZip(source, fn)
+	}
+	return walkTar(source, fn)
+}
+
+func walkZip(source string, fn func(*archiveEntry) error) error {
+	r, err := zip.OpenReader(source)
+	if err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		f := f
+		e := &archiveEntry{name: f.Name, mode: f.Mode(), open: f.Open}
+		if e.mode&fs.ModeSymlink != 0 {
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("%s: %v", source, err)
+			}
+			target, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("%s: %v", source, err)
+			}
+			e.linkname = string(target)
+		} else if !e.mode.IsDir() && !e.mode.IsRegular() {
+			continue
+		}
+		if e.mode.Perm() == 0 {
+			// Archives created on Windows carry no permissions
+			e.mode |= defaultFileMode
+			if e.mode.IsDir() {
+				e.mode |= 0111
+			}
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkTar(source string, fn func(*archiveEntry) error) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch archiveFormat(source) {
+	case ".tar.gz", ".tgz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", source, err)
+		}
+		defer gz.Close()
+		return readTar(source, gz, fn)
+	case ".tar.bz2", ".tbz2":
+		return readTar(source, bzip2.NewReader(f), fn)
+	case ".tar.xz", ".txz":
+		xzr, err := xz.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %v", source, err)
+		}
+		return readTar(source, xzr, fn)
+	}
+	return readTar(source, f, fn)
+}
+
+func readTar(source string, r io.Reader, fn func(*archiveEntry) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", source, err)
+		}
+
+		e := &archiveEntry{name: hdr.Name, mode: hdr.FileInfo().Mode(), linkname: hdr.Linkname}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			e.open = func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }
+		case tar.TypeDir, tar.TypeSymlink:
+		case tar.TypeLink:
+			e.hardlink = true
+		default:
+			// Devices, fifos and extended headers are not extracted
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package modules
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/diceone/for-IT/internal/models"
+	"github.com/ulikunitz/xz"
+)
+
+// testEntry is an entry of a test archive; a linkname makes it a symlink
+// and a trailing / a directory.
+type testEntry struct {
+	name, body, linkname string
+}
+
+func writeTar(t *testing.T, w io.Writer, entries []testEntry) {
+	t.Helper()
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.body))}
+		switch {
+		case e.linkname != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Mode, hdr.Size = tar.TypeSymlink, e.linkname, 0777, 0
+		case strings.HasSuffix(e.name, "/"):
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// makeArchive writes entries to an archive whose format follows from name.
+func makeArchive(t *testing.T, name string, entries []testEntry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"):
+		gz := gzip.NewWriter(f)
+		writeTar(t, gz, entries)
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case strings.HasSuffix(name, ".tar.xz"):
+		xw, err := xz.NewWriter(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTar(t, xw, entries)
+		if err := xw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case strings.HasSuffix(name, ".zip"):
+		zw := zip.NewWriter(f)
+		for _, e := range entries {
+			w, err := zw.Create(e.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(e.body))
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		writeTar(t, f, entries)
+	}
+	return path
+}
+
+func TestUnarchiveFormats(t *testing.T) {
+	entries := []testEntry{{name: "app/"}, {name: "app/README", body: "hello"}}
+	for _, name := range []string{"app.tar", "app.tar.gz", "app.tar.xz", "app.zip"} {
+		t.Run(name, func(t *testing.T) {
+			dest := t.TempDir()
+			spec := &models.UnarchiveSpec{Source: makeArchive(t, name, entries), Dest: dest}
+
+			result, err := runUnarchive(&Host{}, spec)
+			if err != nil || !result.Changed {
+				t.Fatalf("first run: changed = %v, err = %v", result.Changed, err)
+			}
+			if data, _ := os.ReadFile(filepath.Join(dest, "app/README")); string(data) != "hello" {
+				t.Fatalf("app/README = %q, want %q", data, "hello")
+			}
+
+			result, err = runUnarchive(&Host{}, spec)
+			if err != nil || result.Changed {
+				t.Fatalf("second run: changed = %v, err = %v", result.Changed, err)
+			}
+		})
+	}
+}
+
+func TestUnarchiveStripComponents(t *testing.T) {
+	dest := t.TempDir()
+	source := makeArchive(t, "app.tar.gz", []testEntry{
+		{name: "app-1.0/"},
+		{name: "app-1.0/bin/"},
+		{name: "app-1.0/bin/app", body: "binary"},
+	})
+
+	_, err := runUnarchive(&Host{}, &models.UnarchiveSpec{Source: source, Dest: dest, StripComponents: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "bin/app")); string(data) != "binary" {
+		t.Errorf("bin/app = %q, want %q", data, "binary")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "app-1.0")); !os.IsNotExist(err) {
+		t.Errorf("app-1.0 was not stripped: %v", err)
+	}
+}
+
+func TestUnarchiveCreates(t *testing.T) {
+	dest := t.TempDir()
+	source := makeArchive(t, "app.tar", []testEntry{{name: "file", body: "x"}})
+
+	result, err := runUnarchive(&Host{}, &models.UnarchiveSpec{Source: source, Dest: dest, Creates: dest})
+	if err != nil || result.Changed {
+		t.Fatalf("changed = %v, err = %v", result.Changed, err)
+	}
+	if _, err := os.Stat(filepath.Join(dest, "file")); !os.IsNotExist(err) {
+		t.Errorf("archive was extracted despite creates: %v", err)
+	}
+}
+
+func TestUnarchiveOutsideDest(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testEntry
+	}{
+		{"parent directory", []testEntry{{name: "../evil", body: "x"}}},
+		{"nested parent directory", []testEntry{{name: "a/../../evil", body: "x"}}},
+		{"absolute path", []testEntry{{name: "/evil", body: "x"}}},
+		{"through a symlink", []testEntry{{name: "link", linkname: ".."}, {name: "link/evil", body: "x"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dest := filepath.Join(root, "dest")
+			if err := os.Mkdir(dest, 0755); err != nil {
+				t.Fatal(err)
+			}
+			source := makeArchive(t, "evil.tar", tt.entries)
+
+			if _, err := runUnarchive(&Host{}, &models.UnarchiveSpec{Source: source, Dest: dest}); err == nil {
+				t.Fatal("expected an error")
+			}
+			if _, err := os.Stat(filepath.Join(root, "evil")); !os.IsNotExist(err) {
+				t.Errorf("file was written outside of dest: %v", err)
+			}
+		})
+	}
+}
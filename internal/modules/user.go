@@ -0,0 +1,413 @@
+package modules
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/diceone/for-IT/internal/models"
+)
+
+// The account databases read to find the current state of users and groups.
+var (
+	passwdFile = "/etc/passwd"
+	groupFile  = "/etc/group"
+)
+
+type passwdEntry struct {
+	name    string
+	uid     int
+	gid     int
+	comment string
+	home    string
+	shell   string
+}
+
+type groupEntry struct {
+	name    string
+	gid     int
+	members []string
+}
+
+// readAccounts parses a colon separated account database into its records.
+func readAccounts(path string, fields int) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+			continue
+		}
+		record := strings.Split(line, ":")
+		if len(record) < fields {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+func lookupPasswd(name string) (*passwdEntry, error) {
+	records, err := readAccounts(passwdFile, 7)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		if r[0] != name {
+			continue
+		}
+		uid, err1 := strconv.Atoi(r[2])
+		gid, err2 := strconv.Atoi(r[3])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid entry for %s in %s", name, passwdFile)
+		}
+		return &passwdEntry{name: r[0], uid: uid, gid: gid, comment: r[4], home: r[5], shell: r[6]}, nil
+	}
+	return nil, nil
+}
+
+func readGroups() ([]groupEntry, error) {
+	records, err := readAccounts(groupFile, 4)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]groupEntry, 0, len(records))
+	for _, r := range records {
+		gid, err := strconv.Atoi(r[2])
+		if err != nil {
+			continue
+		}
+		var members []string
+		if r[3] != "" {
+			members = strings.Split(r[3], ",")
+		}
+		groups = append(groups, groupEntry{name: r[0], gid: gid, members: members})
+	}
+	return groups, nil
+}
+
+func findGroup(groups []groupEntry, nameOrID string) *groupEntry {
+	gid, err := strconv.Atoi(nameOrID)
+	for i := range groups {
+		if groups[i].name == nameOrID || (err == nil && groups[i].gid == gid) {
+			return &groups[i]
+		}
+	}
+	return nil
+}
+
+// validAccountName rejects names that would corrupt the account databases or
+// be taken for options.
+func validAccountName(name string) error {
+	if name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if strings.HasPrefix(name, "-") || strings.ContainsAny(name, ":,\n\t /") {
+		return fmt.Errorf("invalid name %q", name)
+	}
+	return nil
+}
+
+func validateUser(spec *models.UserSpec) error {
+	if err := validAccountName(spec.Name); err != nil {
+		return err
+	}
+	switch spec.State {
+	case "", "present", "absent":
+	default:
+		return fmt.Errorf("state must be present or absent, not %q", spec.State)
+	}
+	if spec.UID != nil && *spec.UID < 0 {
+		return fmt.Errorf("uid must not be negative")
+	}
+	if spec.Group != "" {
+		if err := validAccountName(spec.Group); err != nil {
+			return fmt.Errorf("group: %v", err)
+		}
+	}
+	for _, group := range spec.Groups {
+		if err := validAccountName(group); err != nil {
+			return fmt.Errorf("groups: %v", err)
+		}
+	}
+	if strings.ContainsAny(spec.Comment, ":\n") {
+		return fmt.Errorf("comment must not contain colons or newlines")
+	}
+	for name, path := range map[string]string{"shell": spec.Shell, "home": spec.Home} {
+		if path != "" && (!filepath.IsAbs(path) || strings.ContainsAny(path, ":\n")) {
+			return fmt.Errorf("%s must be an absolute path", name)
+		}
+	}
+	if spec.State == "absent" && spec.AuthorizedKeys != nil {
+		return fmt.Errorf("authorized_keys is not allowed with state absent")
+	}
+	return nil
+}
+
+func validateGroup(spec *models.GroupSpec) error {
+	if err := validAccountName(spec.Name); err != nil {
+		return err
+	}
+	switch spec.State {
+	case "", "present", "absent":
+	default:
+		return fmt.Errorf("state must be present or absent, not %q", spec.State)
+	}
+	if spec.GID != nil && *spec.GID < 0 {
+		return fmt.Errorf("gid must not be negative")
+	}
+	return nil
+}
+
+func runUser(h *Host, spec *models.UserSpec) (Result, error) {
+	current, err := lookupPasswd(spec.Name)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if spec.State == "absent" {
+		if current == nil {
+			return Result{Output: fmt.Sprintf("user %s already absent", spec.Name)}, nil
+		}
+		args := []string{spec.Name}
+		if spec.Remove {
+			args = []string{"--remove", spec.Name}
+		}
+		return accountCommand(h, fmt.Sprintf("removed user %s", spec.Name), "userdel", args...)
+	}
+
+	groups, err := readGroups()
+	if err != nil {
+		return Result{}, err
+	}
+
+	var (
+		result Result
+		args   []string
+	)
+	if current == nil {
+		args = userOptions(spec, nil, groups)
+		if spec.System {
+			args = append(args, "--system")
+		} else {
+			args = append(args, "--create-home")
+		}
+		result, err = accountCommand(h, fmt.Sprintf("created user %s", spec.Name), "useradd", append(args, spec.Name)...)
+	} else if args = userOptions(spec, current, groups); len(args) > 0 {
+		result, err = accountCommand(h, fmt.Sprintf("changed %s of user %s", optionNames(args), spec.Name), "usermod", append(args, spec.Name)...)
+	} else {
+		result = Result{Output: fmt.Sprintf("user %s already present", spec.Name)}
+	}
+	if err != nil || spec.AuthorizedKeys == nil {
+		return result, err
+	}
+
+	keys, err := ensureAuthorizedKeys(h, spec)
+	if err != nil {
+		return Result{}, err
+	}
+	if keys.Changed {
+		if !result.Changed {
+			result.Output = ""
+		} else {
+			result.Output += "; "
+		}
+		result.Changed = true
+		result.Output += keys.Output
+		result.Diff = keys.Diff
+	}
+	return result, nil
+}
+
+// userOptions returns the useradd/usermod options that make current match
+// spec. current is nil for a new user.
+func userOptions(spec *models.UserSpec, current *passwdEntry, groups []groupEntry) []string {
+	var args []string
+	if spec.UID != nil && (current == nil || current.uid != *spec.UID) {
+		args = append(args, "--uid", strconv.Itoa(*spec.UID))
+	}
+	if spec.Group != "" {
+		group := findGroup(groups, spec.Group)
+		if current == nil || group == nil || group.gid != current.gid {
+			args = append(args, "--gid", spec.Group)
+		}
+	}
+	if spec.Comment != "" && (current == nil || current.comment != spec.Comment) {
+		args = append(args, "--comment", spec.Comment)
+	}
+	if spec.Home != "" && (current == nil || current.home != spec.Home) {
+		args = append(args, "--home", spec.Home)
+	}
+	if spec.Shell != "" && (current == nil || current.shell != spec.Shell) {
+		args = append(args, "--shell", spec.Shell)
+	}
+
+	if spec.Groups != nil {
+		if current == nil {
+			if len(spec.Groups) > 0 {
+				args = append(args, "--groups", strings.Join(spec.Groups, ","))
+			}
+			return args
+		}
+
+		wanted := make(map[string]bool, len(spec.Groups))
+		for _, name := range spec.Groups {
+			if g := findGroup(groups, name); g != nil {
+				name = g.name
+			}
+			wanted[name] = true
+		}
+		// /etc/group does not list users as members of their primary group,
+		// which counts as membership if it is wanted
+		primary := current.gid
+		if g := findGroup(groups, spec.Group); spec.Group != "" && g != nil {
+			primary = g.gid
+		}
+		member := make(map[string]bool)
+		for _, g := range groups {
+			if containsString(g.members, spec.Name) || (g.gid == primary && wanted[g.name]) {
+				member[g.name] = true
+			}
+		}
+
+		missing, extra := false, false
+		for name := range wanted {
+			missing = missing || !member[name]
+		}
+		for name := range member {
+			extra = extra || !wanted[name]
+		}
+		switch {
+		case spec.Append && missing:
+			args = append(args, "--append", "--groups", strings.Join(spec.Groups, ","))
+		case !spec.Append && (missing || extra):
+			args = append(args, "--groups", strings.Join(spec.Groups, ","))
+		}
+	}
+	return args
+}
+
+// optionNames describes the options changed by usermod, e.g. "shell, groups".
+func optionNames(args []string) string {
+	var names []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--") && arg != "--append" {
+			name := strings.TrimPrefix(arg, "--")
+			if name == "gid" {
+				name = "group"
+			}
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// accountCommand runs a user or group management command unless this is a
+// dry run and reports it as a change.
+func accountCommand(h *Host, action, name string, args ...string) (Result, error) {
+	if h.DryRun {
+		return Result{Changed: true, Output: "would have " + action}, nil
+	}
+	if _, err := h.run(nil, name, args...); err != nil {
+		return Result{}, err
+	}
+	return Result{Changed: true, Output: action}, nil
+}
+
+// ensureAuthorizedKeys manages ~/.ssh/authorized_keys like a file task,
+// owned by the user and only readable by them.
+func ensureAuthorizedKeys(h *Host, spec *models.UserSpec) (Result, error) {
+	entry, err := lookupPasswd(spec.Name)
+	if err != nil {
+		return Result{}, err
+	}
+	if entry == nil {
+		// Only possible in a dry run, where the user was not created
+		return Result{Changed: true, Output: "would have written authorized_keys"}, nil
+	}
+
+	uid, gid := strconv.Itoa(entry.uid), strconv.Itoa(entry.gid)
+	sshDir := filepath.Join(entry.home, ".ssh")
+	if _, err := os.Stat(entry.home); os.IsNotExist(err) {
+		return Result{}, fmt.Errorf("home directory %s of user %s does not exist", entry.home, spec.Name)
+	}
+
+	keys := &models.FileSpec{Path: filepath.Join(sshDir, "authorized_keys"), Owner: uid, Group: gid, Mode: "0600", Content: spec.AuthorizedKeys}
+	if _, err := os.Stat(sshDir); os.IsNotExist(err) && h.DryRun {
+		return Result{Changed: true, Output: fmt.Sprintf("would have created %s", keys.Path)}, nil
+	}
+
+	change := &fileChange{}
+	if err := ensureDirectory(h, &models.FileSpec{Path: sshDir, Owner: uid, Group: gid, Mode: "0700"}, change); err != nil {
+		return Result{}, err
+	}
+	result, err := runFile(h, keys, "")
+	if err != nil {
+		return Result{}, err
+	}
+	if len(change.actions) > 0 {
+		prefix := ""
+		if h.DryRun {
+			prefix = "would have "
+		}
+		dirOutput := fmt.Sprintf("%s%s: %s", prefix, sshDir, strings.Join(change.actions, ", "))
+		if result.Changed {
+			result.Output = dirOutput + "; " + result.Output
+		} else {
+			result.Output = dirOutput
+		}
+		result.Changed = true
+	}
+	return result, nil
+}
+
+func runGroup(h *Host, spec *models.GroupSpec) (Result, error) {
+	groups, err := readGroups()
+	if err != nil {
+		return Result{}, err
+	}
+	var current *groupEntry
+	for i := range groups {
+		if groups[i].name == spec.Name {
+			current = &groups[i]
+		}
+	}
+
+	switch {
+	case spec.State == "absent" && current == nil:
+		return Result{Output: fmt.Sprintf("group %s already absent", spec.Name)}, nil
+	case spec.State == "absent":
+		return accountCommand(h, fmt.Sprintf("removed group %s", spec.Name), "groupdel", spec.Name)
+	case current == nil:
+		var args []string
+		if spec.GID != nil {
+			args = append(args, "--gid", strconv.Itoa(*spec.GID))
+		}
+		if spec.System {
+			args = append(args, "--system")
+		}
+		return accountCommand(h, fmt.Sprintf("created group %s", spec.Name), "groupadd", append(args, spec.Name)...)
+	case spec.GID != nil && current.gid != *spec.GID:
+		return accountCommand(h, fmt.Sprintf("changed gid of group %s from %d to %d", spec.Name, current.gid, *spec.GID),
+			"groupmod", "--gid", strconv.Itoa(*spec.GID), spec.Name)
+	}
+	return Result{Output: fmt.Sprintf("group %s already present", spec.Name)}, nil
+}
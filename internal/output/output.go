@@ -1,7 +1,9 @@
 package output
 
 import (
+	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/diceone/for-IT/internal/models"
@@ -9,26 +11,98 @@ import (
 
 func FormatTaskOutput(taskName string, result models.TaskResult, dryRun bool) string {
 	output := fmt.Sprintf("TASK [%s] ****************************************************\n", taskName)
+	if result.Results != nil {
+		// A loop shows every item, then its summary if something happened
+		for _, itemResult := range result.Results {
+			output += formatStatus(itemResult, fmt.Sprintf(" (item=%s)", formatItem(itemResult.Item)))
+		}
+		if result.SkipReason != "" || result.Failed || result.Changed {
+			output += formatStatus(result, "")
+		}
+	} else {
+		output += formatStatus(result, "")
+	}
+	if dryRun {
+		output += "(check mode)\n"
+	}
+	return output
+}
+
+// formatStatus shows the status of a task, or of an item of a loop if suffix
+// names it.
+func formatStatus(result models.TaskResult, suffix string) string {
+	output := ""
 	if result.SkipReason != "" {
-		output += fmt.Sprintf("skipping: [%s]\n", result.SkipReason)
+		output += fmt.Sprintf("skipping: [%s]%s\n", result.SkipReason, suffix)
 	} else if result.Failed {
-		output += fmt.Sprintf("failed: [%s]\n", result.Error)
+		output += fmt.Sprintf("failed: [%s]%s\n", result.Error, suffix)
+		if result.Command != "" {
+			output += fmt.Sprintf("  command: %s\n", result.Command)
+		}
+		if result.ExitCode != nil {
+			output += fmt.Sprintf("  exit code: %d\n", *result.ExitCode)
+		}
+		output += formatTimes(result)
+		output += formatStream("stdout", result.Stdout)
+		output += formatStream("stderr", result.Stderr)
+		output += formatOutputFile(result.OutputFile)
 	} else if result.Changed {
-		output += fmt.Sprintf("changed: [%s]\n", result.Output)
+		output += fmt.Sprintf("changed: [%s]%s\n", result.Output, suffix)
+		output += formatStream("stderr", result.Stderr)
+		output += formatOutputFile(result.OutputFile)
+		output += result.Diff
 	} else {
-		output += "ok\n"
+		output += fmt.Sprintf("ok%s\n", suffix)
 	}
-	if dryRun {
-		output += "(check mode)\n"
+	return output
+}
+
+// formatItem shows a loop item; anything but a string is shown as JSON.
+func formatItem(item interface{}) string {
+	if s, ok := item.(string); ok {
+		return s
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Sprint(item)
+	}
+	return string(data)
+}
+
+// formatStream shows the stdout or stderr of a command below its status line.
+func formatStream(name, text string) string {
+	if text == "" {
+		return ""
+	}
+	output := fmt.Sprintf("  %s:\n", name)
+	for _, line := range strings.Split(text, "\n") {
+		output += "    " + line + "\n"
 	}
 	return output
 }
 
+// formatTimes shows when a task started and ended.
+func formatTimes(result models.TaskResult) string {
+	if result.StartedAt.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("  started: %s, ended: %s\n", result.StartedAt.Format(time.RFC3339), result.EndedAt.Format(time.RFC3339))
+}
+
+func formatOutputFile(file string) string {
+	if file == "" {
+		return ""
+	}
+	return fmt.Sprintf("  full output: %s\n", file)
+}
+
 func FormatPlaybookSummary(results []models.TaskResult, duration time.Duration, dryRun bool) string {
 	output := fmt.Sprintf("PLAY RECAP *********************************************************************\n")
 	for _, result := range results {
 		if result.SkipReason != "" {
 			output += fmt.Sprintf("%s                : skip=%s\n", result.Name, result.SkipReason)
+		} else if result.Rescued {
+			output += fmt.Sprintf("%s                : rescued=%s\n", result.Name, result.Error)
 		} else if result.Failed {
 			output += fmt.Sprintf("%s                : failed=%s\n", result.Name, result.Error)
 		} else if result.Changed {
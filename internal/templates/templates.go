@@ -0,0 +1,125 @@
+// Package templates renders the files in a role's templates/ directory with
+// Go's text/template.
+//
+// Templates see the variables of the environment at the top level
+// ({{ .mariadb.port }}), the host's name as .hostname and its facts as
+// .facts. Referencing an undefined variable is an error; use lookup to read
+// variables that may be missing. Besides the text/template builtins the
+// following functions are available:
+//
+//	default DEF VALUE  VALUE, or DEF if VALUE is empty or undefined
+//	lookup PATH        the variable at a dotted path, or nothing if undefined
+//	env NAME           the host's environment variable NAME
+//	quote VALUE        VALUE as a double-quoted string
+//	indent N TEXT      TEXT with every line indented by N spaces
+//	join SEP LIST      the elements of LIST separated by SEP
+//	toYaml VALUE       VALUE as YAML, without a trailing newline
+package templates
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/diceone/for-IT/internal/vars"
+	"gopkg.in/yaml.v3"
+)
+
+// Parse parses a template. name is used in error messages and should be the
+// template's file name.
+func Parse(name, text string) (*template.Template, error) {
+	return template.New(name).Option("missingkey=error").Funcs(funcs(nil)).Parse(text)
+}
+
+// Render parses and executes a template against data. Errors carry the
+// template's name and the line and column of the failing action.
+func Render(name, text string, data map[string]interface{}) (string, error) {
+	t, err := Parse(name, text)
+	if err != nil {
+		return "", err
+	}
+	t.Funcs(funcs(data))
+
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func funcs(data map[string]interface{}) template.FuncMap {
+	return template.FuncMap{
+		"default": defaultValue,
+		"lookup": func(path string) interface{} {
+			value, _ := vars.Scope(data).Lookup(path)
+			return value
+		},
+		"env":    os.Getenv,
+		"quote":  quote,
+		"indent": indent,
+		"join":   join,
+		"toYaml": toYaml,
+	}
+}
+
+func defaultValue(def interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || isEmpty(value[0]) {
+		return def
+	}
+	return value[0]
+}
+
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func quote(value interface{}) string {
+	if value == nil {
+		return `""`
+	}
+	return strconv.Quote(fmt.Sprint(value))
+}
+
+func indent(n int, text string) string {
+	pad := strings.Repeat(" ", n)
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = pad + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func join(sep string, list interface{}) (string, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: %T is not a list", list)
+	}
+	parts := make([]string, v.Len())
+	for i := range parts {
+		parts[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return strings.Join(parts, sep), nil
+}
+
+func toYaml(value interface{}) (string, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
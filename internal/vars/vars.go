@@ -0,0 +1,368 @@
+// Package vars implements the ${...} variable interpolation used in task
+// commands.
+//
+// A reference is written as ${path} where path is a dotted lookup into the
+// scope, e.g. ${mariadb.port}. ${path:-default} falls back to default when
+// the variable is undefined or empty. $${ renders as a literal ${, which
+// allows shell parameter expansion to pass through untouched. Any other $ is
+// left alone.
+//
+// Variables registered by a task are only known on the client. The server
+// renders the tasks after it with Defer, which keeps the references to them,
+// and the client renders the rest.
+package vars
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/diceone/for-IT/internal/models"
+)
+
+// Scope holds the variables available to a template. Nested maps are
+// addressed with dotted paths.
+type Scope map[string]interface{}
+
+// NewScope builds the scope of an environment file: every entry of its
+// variables map is available at the top level and every free-form section
+// (e.g. mariadb:) under its own name.
+func NewScope(env models.Environment) Scope {
+	scope := make(Scope, len(env.Variables)+len(env.Sections))
+	for name, value := range env.Sections {
+		scope[name] = value
+	}
+	for name, value := range env.Variables {
+		scope[name] = value
+	}
+	return scope
+}
+
+// Deferred is the value of a variable that only the client knows, such as
+// the registered result of an earlier task.
+type Deferred struct{}
+
+// ErrDeferred is returned by Render for a reference to a Deferred variable.
+var ErrDeferred = errors.New("only known on the client")
+
+// Lookup resolves a dotted path such as mariadb.port.
+func (s Scope) Lookup(path string) (interface{}, bool) {
+	var current interface{} = map[string]interface{}(s)
+	for _, key := range strings.Split(path, ".") {
+		switch m := current.(type) {
+		case map[string]interface{}:
+			value, ok := m[key]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case Scope:
+			value, ok := m[key]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case map[string]string:
+			value, ok := m[key]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// Render replaces every variable reference in text with its value from the
+// scope. It fails on undefined variables that have no default.
+func Render(text string, scope Scope) (string, error) {
+	return renderer{scope: scope}.render(text)
+}
+
+// Defer renders text like Render but keeps the references to Deferred
+// variables, so that the result is a template for the client. Any other ${
+// in the result, whether written as $${ or part of a value, is escaped as $${
+// again.
+func Defer(text string, scope Scope) (string, error) {
+	return renderer{scope: scope, deferred: true}.render(text)
+}
+
+// renderer renders templates against a scope, keeping the references to
+// Deferred variables if deferred is set.
+type renderer struct {
+	scope    Scope
+	deferred bool
+}
+
+func (r renderer) render(text string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(text, '$')
+		if i < 0 {
+			b.WriteString(text)
+			return b.String(), nil
+		}
+		b.WriteString(text[:i])
+		text = text[i:]
+
+		switch {
+		case strings.HasPrefix(text, "$${"):
+			b.WriteString(r.literal("${"))
+			text = text[3:]
+		case strings.HasPrefix(text, "${"):
+			end := strings.IndexByte(text, '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable reference %q", text)
+			}
+			if path := r.deferredPath(text[2:end]); path != "" {
+				if !r.deferred {
+					return "", fmt.Errorf("variable %q: %w", path, ErrDeferred)
+				}
+				b.WriteString(text[:end+1])
+				text = text[end+1:]
+				continue
+			}
+			value, err := resolve(text[2:end], r.scope)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(r.literal(value))
+			text = text[end+1:]
+		default:
+			b.WriteByte('$')
+			text = text[1:]
+		}
+	}
+}
+
+// literal returns text as it is written in the rendered result.
+func (r renderer) literal(text string) string {
+	if r.deferred {
+		return strings.ReplaceAll(text, "${", "$${")
+	}
+	return text
+}
+
+// deferredPath returns the path of a reference to a Deferred variable, or ""
+// for any other reference.
+func (r renderer) deferredPath(ref string) string {
+	path, _, _ := strings.Cut(ref, ":-")
+	path = strings.TrimSpace(path)
+	root, _, _ := strings.Cut(path, ".")
+	if _, ok := r.scope[root].(Deferred); ok {
+		return path
+	}
+	return ""
+}
+
+// resolve evaluates the body of a ${...} reference.
+func resolve(ref string, scope Scope) (string, error) {
+	path, def, hasDefault := strings.Cut(ref, ":-")
+	path = strings.TrimSpace(path)
+	if path == "" {
+		return "", fmt.Errorf("empty variable reference")
+	}
+
+	value, ok := scope.Lookup(path)
+	if ok {
+		s, err := Format(value)
+		if err != nil {
+			return "", fmt.Errorf("variable %q: %v", path, err)
+		}
+		if s != "" || !hasDefault {
+			return s, nil
+		}
+	}
+	if hasDefault {
+		return def, nil
+	}
+	return "", fmt.Errorf("undefined variable %q", path)
+}
+
+// Format converts a scalar variable value to its string form.
+func Format(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case fmt.Stringer:
+		return v.String(), nil
+	default:
+		return "", fmt.Errorf("value of type %T is not a scalar", value)
+	}
+}
+
+// RenderAll returns a deep copy of value with variable references rendered in
+// every string it contains, including struct fields, slices and map values.
+// It is used for the arguments of typed modules.
+func RenderAll(value interface{}, scope Scope) (interface{}, error) {
+	rendered, err := renderer{scope: scope}.renderValue(reflect.ValueOf(value))
+	if err != nil || !rendered.IsValid() {
+		return nil, err
+	}
+	return rendered.Interface(), nil
+}
+
+// RenderTask renders the command, environment and module arguments of a task.
+func RenderTask(task models.Task, scope Scope) (models.Task, error) {
+	return renderer{scope: scope}.renderTask(task)
+}
+
+// DeferTask renders a task like RenderTask but keeps the references to
+// Deferred variables, see Defer. The client renders the result with
+// RenderTask once it knows their values.
+func DeferTask(task models.Task, scope Scope) (models.Task, error) {
+	return renderer{scope: scope, deferred: true}.renderTask(task)
+}
+
+func (r renderer) renderTask(task models.Task) (models.Task, error) {
+	command, err := r.render(task.Command)
+	if err != nil {
+		return task, err
+	}
+	task.Command = command
+
+	if task.Variables, err = r.renderMap(task.Variables); err != nil {
+		return task, fmt.Errorf("variables: %w", err)
+	}
+	if task.Env, err = r.renderMap(task.Env); err != nil {
+		return task, fmt.Errorf("env: %w", err)
+	}
+	modules, err := r.renderValue(reflect.ValueOf(task.Modules))
+	if err != nil {
+		return task, err
+	}
+	task.Modules = modules.Interface().(models.Modules)
+	guards, err := r.renderValue(reflect.ValueOf(task.Guards))
+	if err != nil {
+		return task, err
+	}
+	task.Guards = guards.Interface().(models.Guards)
+	return task, nil
+}
+
+func (r renderer) renderMap(values map[string]string) (map[string]string, error) {
+	if values == nil {
+		return nil, nil
+	}
+	rendered := make(map[string]string, len(values))
+	for key, value := range values {
+		v, err := r.render(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		rendered[key] = v
+	}
+	return rendered, nil
+}
+
+func (r renderer) renderValue(v reflect.Value) (reflect.Value, error) {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := r.render(v.String())
+		if err != nil {
+			return v, err
+		}
+		return reflect.ValueOf(s).Convert(v.Type()), nil
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v, nil
+		}
+		elem, err := r.renderValue(v.Elem())
+		if err != nil {
+			return v, err
+		}
+		p := reflect.New(v.Type().Elem())
+		p.Elem().Set(elem)
+		return p, nil
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return v, nil
+		}
+		elem, err := r.renderValue(v.Elem())
+		if err != nil {
+			return v, err
+		}
+		i := reflect.New(v.Type()).Elem()
+		i.Set(elem)
+		return i, nil
+
+	case reflect.Struct:
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if !copied.Field(i).CanSet() {
+				continue
+			}
+			field, err := r.renderValue(v.Field(i))
+			if err != nil {
+				if name := fieldName(v.Type().Field(i)); name != "" {
+					err = fmt.Errorf("%s: %w", name, err)
+				}
+				return v, err
+			}
+			copied.Field(i).Set(field)
+		}
+		return copied, nil
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return v, nil
+		}
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			elem, err := r.renderValue(v.Index(i))
+			if err != nil {
+				return v, err
+			}
+			copied.Index(i).Set(elem)
+		}
+		return copied, nil
+
+	case reflect.Map:
+		if v.IsNil() {
+			return v, nil
+		}
+		copied := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			elem, err := r.renderValue(iter.Value())
+			if err != nil {
+				return v, fmt.Errorf("%v: %w", iter.Key(), err)
+			}
+			copied.SetMapIndex(iter.Key(), elem)
+		}
+		return copied, nil
+	}
+	return v, nil
+}
+
+// fieldName returns the name a struct field has in playbooks, or "" for an
+// inlined struct whose fields appear directly in its parent.
+func fieldName(field reflect.StructField) string {
+	name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	switch {
+	case opts == "inline":
+		return ""
+	case name != "" && name != "-":
+		return name
+	}
+	return field.Name
+}
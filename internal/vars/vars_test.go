@@ -0,0 +1,167 @@
+package vars
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/diceone/for-IT/internal/models"
+)
+
+var scope = Scope{
+	"APP_ENV": "staging",
+	"empty":   "",
+	"mariadb": map[string]interface{}{"port": 3306, "tuned": true, "ratio": 0.5},
+	"labels":  map[string]string{"tier": "db"},
+	"hosts":   []interface{}{"a", "b"},
+	"nothing": nil,
+}
+
+func TestRender(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"no references", "no references"},
+		{"${APP_ENV}", "staging"},
+		{"port=${mariadb.port} tuned=${mariadb.tuned} ratio=${mariadb.ratio}", "port=3306 tuned=true ratio=0.5"},
+		{"${ mariadb.port }", "3306"},
+		{"${labels.tier}", "db"},
+		{"${nothing}", ""},
+
+		// Defaults apply to undefined and empty variables
+		{"${missing:-fallback}", "fallback"},
+		{"${mariadb.socket:-/run/mysqld.sock}", "/run/mysqld.sock"},
+		{"${empty:-fallback}", "fallback"},
+		{"${APP_ENV:-fallback}", "staging"},
+		{"${missing:-}", ""},
+
+		// $${ is a literal ${ and any other $ is left alone
+		{"$${HOME}", "${HOME}"},
+		{"echo $${PATH:-/bin} ${APP_ENV}", "echo ${PATH:-/bin} staging"},
+		{"echo $HOME $1 $$ cost$", "echo $HOME $1 $$ cost$"},
+	}
+	for _, tt := range tests {
+		got, err := Render(tt.text, scope)
+		if err != nil {
+			t.Errorf("Render(%q): %v", tt.text, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Render(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	tests := []struct {
+		text, err string
+	}{
+		{"${missing}", `undefined variable "missing"`},
+		{"${mariadb.socket}", `undefined variable "mariadb.socket"`},
+		{"${APP_ENV.x}", `undefined variable "APP_ENV.x"`},
+		{"${}", "empty variable reference"},
+		{"${APP_ENV", "unterminated variable reference"},
+		{"${hosts}", `variable "hosts": value of type []interface {} is not a scalar`},
+		{"${mariadb}", `variable "mariadb"`},
+	}
+	for _, tt := range tests {
+		_, err := Render(tt.text, scope)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Render(%q) error = %v, want %q", tt.text, err, tt.err)
+		}
+	}
+}
+
+func TestRenderAll(t *testing.T) {
+	spec := &models.FileSpec{Path: "/etc/${APP_ENV}.conf", Owner: "$${USER}"}
+	rendered, err := RenderAll(spec, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &models.FileSpec{Path: "/etc/staging.conf", Owner: "${USER}"}
+	if !reflect.DeepEqual(rendered, want) {
+		t.Errorf("RenderAll = %+v, want %+v", rendered, want)
+	}
+	if spec.Path != "/etc/${APP_ENV}.conf" {
+		t.Errorf("RenderAll modified its argument: %q", spec.Path)
+	}
+
+	args := map[string]interface{}{"list": []interface{}{"${mariadb.port}", 1}, "nested": map[string]interface{}{"env": "${APP_ENV}"}}
+	rendered, err = RenderAll(args, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantArgs := map[string]interface{}{"list": []interface{}{"3306", 1}, "nested": map[string]interface{}{"env": "staging"}}
+	if !reflect.DeepEqual(rendered, wantArgs) {
+		t.Errorf("RenderAll = %v, want %v", rendered, wantArgs)
+	}
+}
+
+func TestDefer(t *testing.T) {
+	deferred := Scope{"APP_ENV": "staging", "dollar": "cost ${x}", "result": Deferred{}, "item": Deferred{}}
+	tests := []struct {
+		text, want string
+	}{
+		{"${APP_ENV} ${result.stdout}", "staging ${result.stdout}"},
+		{"${result.rc:-0} ${item}", "${result.rc:-0} ${item}"},
+		// Literals stay escaped so that the client does not resolve them
+		{"$${HOME} ${result.stdout}", "$${HOME} ${result.stdout}"},
+		{"${dollar}", "cost $${x}"},
+	}
+	for _, tt := range tests {
+		got, err := Defer(tt.text, deferred)
+		if err != nil {
+			t.Errorf("Defer(%q): %v", tt.text, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Defer(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+
+	// Render refuses what only the client knows
+	_, err := Render("${result.stdout}", deferred)
+	if !errors.Is(err, ErrDeferred) {
+		t.Errorf("Render of a deferred variable: error = %v, want ErrDeferred", err)
+	}
+}
+
+func TestDeferTaskRoundTrip(t *testing.T) {
+	server := Scope{"APP_ENV": "staging", "result": Deferred{}}
+	task := models.Task{
+		Command: "echo ${APP_ENV} ${result.stdout} $${HOME}",
+		Env:     map[string]string{"RC": "${result.rc}"},
+		Modules: models.Modules{File: &models.FileSpec{Path: "/srv/${APP_ENV}/${result.stdout}"}},
+		Guards:  models.Guards{Creates: "/srv/${result.stdout}"},
+	}
+
+	deferred, err := DeferTask(task, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "echo staging ${result.stdout} $${HOME}"; deferred.Command != want {
+		t.Errorf("deferred command = %q, want %q", deferred.Command, want)
+	}
+
+	client := Scope{"result": map[string]interface{}{"stdout": "v2", "rc": 0}}
+	rendered, err := RenderTask(deferred, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "echo staging v2 ${HOME}"; rendered.Command != want {
+		t.Errorf("command = %q, want %q", rendered.Command, want)
+	}
+	if got := rendered.Env["RC"]; got != "0" {
+		t.Errorf("env RC = %q, want %q", got, "0")
+	}
+	if got := rendered.File.Path; got != "/srv/staging/v2" {
+		t.Errorf("file path = %q, want %q", got, "/srv/staging/v2")
+	}
+	if got := rendered.Creates; got != "/srv/v2" {
+		t.Errorf("creates = %q, want %q", got, "/srv/v2")
+	}
+	if task.File.Path != "/srv/${APP_ENV}/${result.stdout}" {
+		t.Errorf("DeferTask modified the task: %q", task.File.Path)
+	}
+}
@@ -72,6 +72,7 @@ install_server() {
     
     # Create necessary directories
     mkdir -p /etc/for/environments/roles/common
+    mkdir -p /etc/for/playbooks
     mkdir -p /var/log/for
 
     # Create for user and group if they don't exist
@@ -105,7 +106,7 @@ install_server() {
     chown -R for:for /etc/for
     chown -R for:for /var/log/for
     chmod 755 /etc/for
-    chmod 755 /etc/for/environments
+    chmod 755 /etc/for/environments /etc/for/playbooks
     chmod -R 644 /etc/for/environments/*
     chmod 755 $(find /etc/for/environments -type d)
 